@@ -25,10 +25,19 @@ type configInfo struct {
 	serviceCode string
 	contentType string
 	bitrateType string
+	pool        *ipPool // set when destIP is a CIDR or range
+
+	// scenario file settings, unset takes the command line flags
+	weight           float64
+	playMin, playMax int // playtime range in seconds
+	streamingType    string
+	gslb             *bool
+	behavior         *behaviorConfig
 }
 
 type gslbSetup struct {
 	address        string
+	scheme         string
 	ServiceCode    string `json:"serviceCode"`
 	ClientIP       string `json:"clientIp"`
 	ProtocolType   string `json:"protocolType"`
@@ -45,13 +54,20 @@ type gslbresponse struct {
 	ErrorString string   `json:"errorString"`
 }
 
-func gslbsetup(info *gslbSetup) (string, error) {
+// gslbsetup returns the one time urls of the gslb response, the first one is preferred.
+func gslbsetup(info *gslbSetup, c *http.Client) ([]string, error) {
 	doc, _ := json.Marshal(info)
 	buff := bytes.NewBuffer(doc)
-	url := "http://" + info.address + "/command/demandOtu"
-	resp, err := http.Post(url, "application/json", buff)
+	url := info.scheme + "://" + info.address + "/command/demandOtu"
+	req, err := http.NewRequest("POST", url, buff)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	req = withPhase(req, "gslb")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
 	}
 
 	defer resp.Body.Close()
@@ -60,19 +76,39 @@ func gslbsetup(info *gslbSetup) (string, error) {
 	case 200:
 		res, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		data := gslbresponse{}
 		json.Unmarshal(res, &data)
 		if data.ResultCode != 200 {
-			return "", fmt.Errorf(data.ErrorString)
+			return nil, fmt.Errorf(data.ErrorString)
+		}
+		if len(data.OneTimeURL) == 0 {
+			return nil, fmt.Errorf("no oneTimeUrl in gslb response")
 		}
-		return data.OneTimeURL[0], err
+		return data.OneTimeURL, nil
 
 	default:
-		return "", fmt.Errorf("Status Code = %d", resp.StatusCode)
+		return nil, fmt.Errorf("Status Code = %d", resp.StatusCode)
+	}
+}
+
+// newGSLBClient creates the client shared by the gslb requests of all sessions.
+func newGSLBClient(cfg *sessionConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         cfg.resolver.dial(dialer, nil),
+		DialTLSContext:      tlsDial(cfg.resolver.dial(dialer, nil), cfg.tls, nil),
+		ForceAttemptHTTP2:   cfg.http2,
+		TLSHandshakeTimeout: 10 * time.Second,
 	}
+	return &http.Client{Transport: &tracingTransport{base: transport}}
 }
 
 func glbSetup(u *url.URL, c *http.Client) (*url.URL, error) {
@@ -82,11 +118,13 @@ func glbSetup(u *url.URL, c *http.Client) (*url.URL, error) {
 		return nil, err
 	}
 
+	req = withPhase(req, "glb")
 	req.Header.Set("X-Castis-User-Agent", "dahakan")
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != 301 {
 		return nil, fmt.Errorf("Received HTTP %v for %v", resp.StatusCode, u.String())
@@ -108,6 +146,7 @@ func vodsetup(u *url.URL, c *http.Client) (io.ReadCloser, *url.URL, error) {
 		return nil, nil, err
 	}
 
+	req = withPhase(req, "vod")
 	req.Header.Set("X-Castis-User-Agent", "dahakan")
 	resp, err := c.Do(req)
 	if err != nil {
@@ -124,26 +163,46 @@ func vodsetup(u *url.URL, c *http.Client) (io.ReadCloser, *url.URL, error) {
 
 }
 
-func getContent(u *url.URL, c *http.Client) (io.ReadCloser, *url.URL, error) {
+// getRangeResponse requests the sub-range r of u, or the whole resource when r is nil.
+// phase tags the request timing.
+func getRangeResponse(u *url.URL, c *http.Client, r *byteRange, phase string) (*http.Response, error) {
 
 	log.Println(u.String())
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	req = withPhase(req, phase)
 
 	req.Header.Set("User-Agent", "dahakan")
+	status := 200
+	if r != nil {
+		req.Header.Set("Range", r.header())
+		status = 206
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("Received HTTP %v for %v", resp.StatusCode, u.String())
+	if resp.StatusCode != status {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Received HTTP %v for %v", resp.StatusCode, u.String())
 	}
 
 	log.Printf("Received HTTP %v for %v\n", resp.StatusCode, u.String())
 
+	return resp, err
+}
+
+// getContent requests u, phase tags the request timing.
+func getContent(u *url.URL, c *http.Client, phase string) (io.ReadCloser, *url.URL, error) {
+	resp, err := getRangeResponse(u, c, nil, phase)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	resurl := resp.Request
 
 	return resp.Body, resurl.URL, err
@@ -185,21 +244,163 @@ func absolutize(rawurl string, u *url.URL) (uri *url.URL, err error) {
 	return
 }
 
-func download(u *url.URL, c *http.Client, f float64) error {
+func getMediaPlaylist(u *url.URL, s *session) (*m3u8.MediaPlaylist, error) {
+	var mediapl *m3u8.MediaPlaylist
 	start := time.Now()
-	content, _, err := getContent(u, c)
+	err := s.retry("playlist", func() error {
+		start = time.Now()
+		var err error
+		mediapl, err = fetchMediaPlaylist(u, s)
+		return err
+	})
 	if err != nil {
+		s.fail("playlist")
+		return nil, err
+	}
+	stats.observe("playlist", time.Now().Sub(start))
+
+	prepareSegments(mediapl)
+
+	return mediapl, nil
+}
+
+func fetchMediaPlaylist(u *url.URL, s *session) (*m3u8.MediaPlaylist, error) {
+	content, _, err := getContent(u, s.client, "playlist")
+	if err != nil {
+		return nil, err
+	}
+
+	playlist, listType, err := m3u8.DecodeFrom(content, true)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if listType != m3u8.MEDIA {
+		return nil, fmt.Errorf("invaild m3u8 Type")
+	}
+	return playlist.(*m3u8.MediaPlaylist), nil
+}
+
+// downloadSegment downloads a media segment of a playlist loaded from base.
+// seq is the media sequence number of the segment, used as default IV.
+// phase is segment for the main track, audio or subtitles for a rendition.
+func downloadSegment(segment *m3u8.MediaSegment, seq uint64, base *url.URL, s *session, f float64, phase string) (int64, time.Duration, error) {
+	segURL, err := absolutize(segment.URI, base)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var dec *segmentDecrypter
+	opaque := false // AES-128 without decryption, only the size can be validated
+	if segment.Key != nil && segment.Key.URI != "" {
+		key, err := getKey(segment.Key, base, s)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if s.cfg.decrypt && segment.Key.Method == keyAES128 {
+			iv, err := keyIV(segment.Key, seq)
+			if err != nil {
+				return 0, 0, err
+			}
+			dec, err = newSegmentDecrypter(key, iv)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		// SAMPLE-AES keeps the container intact, AES-128 encrypts all of it
+		opaque = dec == nil && segment.Key.Method == keyAES128
+	}
+
+	if segment.Map != nil {
+		if err := getInit(segment.Map, base, s); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return downloadPhase(phase, segURL, segmentRange(segment), s, f, dec, opaque)
+}
+
+// downloadPhase reads the whole segment and paces the session to the playback of its duration f,
+// timing and errors are reported under phase. it returns the received size and the transfer time
+// without pacing. dec decrypts the segment for validation, it may be nil, an opaque segment is
+// encrypted without dec and its content is not validated.
+func downloadPhase(phase string, u *url.URL, r *byteRange, s *session, f float64, dec *segmentDecrypter, opaque bool) (int64, time.Duration, error) {
+	if f > 0 {
+		// renditions may fetch up to the end of this segment meanwhile
+		s.clock.advance(f)
+	}
+
+	var size int64
+	var elapsed time.Duration
+	err := s.retry(phase, func() error {
+		if dec != nil {
+			dec.reset()
+		}
+		var err error
+		size, elapsed, err = transfer(phase, u, r, s, dec, opaque)
 		return err
+	})
+	if err != nil {
+		// a rendition fails on its own, the main track plays on
+		if mainTrack(phase) {
+			s.fail(phase)
+			s.segmentFailed(size)
+		}
+		return size, 0, err
 	}
 
+	if f > 0 {
+		s.buffer.add(f, time.Now())
+		// without a buffer target the client keeps the next segment buffered ahead of playback,
+		// pacing by the transfer time of each segment would leave the buffer just under one segment
+		target := s.cfg.bufferTarget
+		if target <= 0 {
+			target = f
+		}
+		s.sleep(s.buffer.wait(target))
+	}
+
+	return size, elapsed, nil
+}
+
+// transfer requests the segment once and reads, decrypts and validates it.
+func transfer(phase string, u *url.URL, r *byteRange, s *session, dec *segmentDecrypter, opaque bool) (int64, time.Duration, error) {
+	start := time.Now()
+	resp, err := getRangeResponse(u, s.client, r, phase)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	content := resp.Body
 	defer content.Close()
 
+	var validator *segmentValidator
+	if s.cfg.validate {
+		validator = newSegmentValidator()
+		if opaque {
+			// ciphertext, the Content-Length check is all that is left
+			validator.format = formatOther
+		}
+	}
+
+	var size int64
 	for {
 		buf := make([]byte, 32*1024)
-		_, err := content.Read(buf)
+		nr, err := content.Read(buf)
+		size += int64(nr)
+
+		plain := buf[:nr]
+		if dec != nil {
+			plain = dec.decrypt(plain)
+		}
+		if validator != nil {
+			validator.Write(plain)
+		}
 
 		if err != nil && err != io.EOF {
-			return err
+			return size, 0, err
 		}
 
 		if err == io.EOF {
@@ -207,17 +408,56 @@ func download(u *url.URL, c *http.Client, f float64) error {
 		}
 	}
 
+	if err := checkRangeSize(r, size); err != nil {
+		return size, 0, err
+	}
+
+	elapsed := time.Now().Sub(start)
+	stats.observe(phase, elapsed)
 	log.Printf("Data Received Complete %v\n", u.String())
 
-	restime := int(f*1000) - (int(time.Now().Sub(start)) / 1000000)
-	time.Sleep(time.Duration(restime * 1000000))
+	s.mu.Lock()
+	if mainTrack(phase) {
+		s.segments++
+	}
+	s.bytes += size
+	s.mu.Unlock()
+	if mainTrack(phase) {
+		metrics.segment(s, size, elapsed)
+	}
+	if dec != nil {
+		plain, err := dec.finish()
+		decryption.record(err != nil)
+		if err != nil {
+			s.mu.Lock()
+			s.decryptFailed++
+			s.mu.Unlock()
+			log.Printf("[%d] decrypt failed %v: %s", s.n, u.String(), err)
+		} else if validator != nil {
+			validator.Write(plain)
+		}
+	}
 
-	return nil
+	if validator != nil {
+		err := validator.finish()
+		if err == nil && resp.ContentLength >= 0 && resp.ContentLength != size {
+			err = fmt.Errorf("received %d bytes, Content-Length %d", size, resp.ContentLength)
+		}
+		validation.record(u.Host, err != nil)
+		if err != nil {
+			s.mu.Lock()
+			s.corrupt++
+			s.mu.Unlock()
+			log.Printf("[%d] corrupt segment %v: %s", s.n, u.String(), err)
+		}
+	}
+
+	return size, elapsed, nil
 }
 
 func disconnectDownload(u *url.URL, c *http.Client, f float64) error {
 	start := time.Now()
-	content, _, err := getContent(u, c)
+	content, _, err := getContent(u, c, "segment")
 	if err != nil {
 		return err
 	}
@@ -242,229 +482,441 @@ func disconnectDownload(u *url.URL, c *http.Client, f float64) error {
 	return nil
 }
 
-func getPlaylist(v *m3u8.Variant, u *url.URL, t int, c *http.Client, n int) {
-	msURL, err := absolutize(v.URI, u)
-	if err != nil {
-		log.Println("error:", err)
-		return
-	}
-
-	content, _, err := getContent(msURL, c)
-	if err != nil {
-		log.Println("error:", err)
-		return
-	}
-
-	playlist, listType, err := m3u8.DecodeFrom(content, true)
+func getPlaylist(p *player, u *url.URL, t int, s *session) {
+	n := s.n
+	mediapl, msURL, err := p.playlist(u, s)
 	if err != nil {
-		log.Println("error:", err)
+		s.logError(err)
 		return
 	}
-	content.Close()
 
-	if listType != m3u8.MEDIA {
-		log.Println("error: invaild m3u8 Type")
-		return
-	}
+	endRenditions := startRenditions(p, u, t, s)
+	defer func() {
+		endRenditions()
+	}()
 
-	mediapl := playlist.(*m3u8.MediaPlaylist)
 	if mediapl.Closed == false {
 		// live ( OTM Channel )
+		s.kind = "adaptive live"
 		log.Printf("[%d] Adaptive Channel Session (OTM Channel)", n)
-		for t > 0 {
+		variantURL := func() (*url.URL, error) {
+			return absolutize(p.variant().URI, u)
+		}
+		played := func(size int64, elapsed time.Duration, duration float64) bool {
+			p.update(size, elapsed, duration)
+			return p.next()
+		}
+		err = errNotLowLatency
+		if s.cfg.lowLatency {
+			err = playLowLatency(s, t, variantURL, played)
+		}
+		if err == errNotLowLatency {
+			err = playLive(s, t, s.cfg.liveDelay, mediapl, msURL, variantURL, played)
+		}
+		if err != nil {
+			s.logError(err)
+			return
+		}
+	} else {
+		// vod ( OTM VOD )
+		s.kind = "adaptive vod"
+		log.Printf("[%d] Adaptive VOD Session (OTM VOD)", n)
+		for idx := 0; idx < len(mediapl.Segments); {
+			segment := mediapl.Segments[idx]
+			start := time.Now()
+
 			// chunk download
-			for idx, segment := range mediapl.Segments {
-				if segment == nil {
-					chunk := mediapl.Segments[idx-1]
-					if chunk != nil {
-						chunkURL, err := absolutize(chunk.URI, u)
-						if err != nil {
-							log.Println("error:", err)
-							return
-						}
-						err = download(chunkURL, c, chunk.Duration)
-						if err != nil {
-							log.Println("error:", err)
-							return
-						}
-						t -= int(chunk.Duration)
-					}
-				}
-				break
-			}
-			//m3u8 update
-			{
-				content, _, err = getContent(msURL, c)
+			if segment != nil {
+				size, elapsed, err := downloadSegment(segment, mediapl.SeqNo+uint64(idx), msURL, s, segment.Duration, "segment")
 				if err != nil {
-					log.Println("error:", err)
+					s.logError(err)
 					return
 				}
+				p.update(size, elapsed, segment.Duration)
+			} else {
+				return
+			}
 
-				playlist, listType, err = m3u8.DecodeFrom(content, true)
+			t -= int(int(time.Now().Sub(start)) / 1000000000)
+			if t <= 0 || s.stopped() {
+				break
+			}
+
+			next, zap := vodAction(s, mediapl, idx, segment.Duration)
+			if zap {
+				s.zap = true
+				break
+			}
+			if next != idx+1 {
+				// renditions restart at the seek position
+				endRenditions()
+				s.clock = newMediaClock(segmentStart(mediapl, next))
+				endRenditions = startRenditions(p, u, t, s)
+			}
+			idx = next
+
+			if p.next() {
+				// continue at the same segment index of the new variant
+				mediapl, msURL, err = p.playlist(u, s)
 				if err != nil {
-					log.Println("error:", err)
+					s.logError(err)
 					return
 				}
-				content.Close()
-
-				mediapl = playlist.(*m3u8.MediaPlaylist)
 			}
 		}
-	} else {
-		// vod ( OTM VOD )
-		log.Printf("[%d] Adaptive VOD Session (OTM VOD)", n)
-		var subplaylist m3u8.Playlist
-		var audioplaylist m3u8.Playlist
-		for _, alt := range v.Alternatives {
-			// sub, audio list download
-			if alt.URI != "" {
-				if alt.Type == "SUBTITLES" && subplaylist == nil {
-					altURL, err := absolutize(alt.URI, u)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
+	}
+}
 
-					content, _, err := getContent(altURL, c)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
+// newClient creates the http client of s bound to the local address destIP.
+func newClient(s *session, destIP string) (*http.Client, error) {
+	localAddr, err := net.ResolveIPAddr("ip", destIP)
+	if err != nil {
+		return nil, err
+	}
 
-					subplaylist, listType, err = m3u8.DecodeFrom(content, true)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
-					content.Close()
+	LocalBindAddr := &net.TCPAddr{IP: localAddr.IP}
 
-					if listType != m3u8.MEDIA {
-						log.Println("error: invaild m3u8 Type")
-						return
-					}
-				}
+	dialer := &net.Dialer{
+		LocalAddr: LocalBindAddr,
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
 
-				if alt.Type == "AUDIO" && audioplaylist == nil {
-					altURL, err := absolutize(alt.URI, u)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
+	var httpTransport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           throttledDial(s.cfg.resolver.dial(dialer, s), s),
+		DialTLSContext:        tlsDial(throttledDial(s.cfg.resolver.dial(dialer, s), s), s.cfg.tls, s),
+		ForceAttemptHTTP2:     s.cfg.http2,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		//Android
+		DisableKeepAlives: s.cfg.disableKeepAlive,
+	}
 
-					content, _, err := getContent(altURL, c)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
+	var transport http.RoundTripper = &tracingTransport{base: httpTransport, s: s}
+	timeout := requestTimeout
+	if s.limiter != nil {
+		// a capped segment takes as long as the rate makes it, only a server that does not answer times out
+		transport = &headerTimeoutTransport{base: transport, timeout: requestTimeout}
+		timeout = 0
+	}
 
-					audioplaylist, listType, err = m3u8.DecodeFrom(content, true)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
-					content.Close()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 
-					if listType != m3u8.MEDIA {
-						log.Println("error: invaild m3u8 Type")
-						return
-					}
-				}
-			}
+	return client, nil
+}
+
+// runSession plays the content of cfg for t seconds, moving on to other entries when the viewer zaps.
+func runSession(s *session, t int, cfg configInfo) {
+	control.track(s)
+	defer control.untrack(s)
+
+	s.buffer = newPlaybackBuffer(time.Now(), s.cfg.bufferStartup)
+
+	metrics.sessionStarted()
+	defer metrics.sessionEnded(s)
+	defer results.record(s)
+	defer endPlayback(s)
+	defer s.releaseIP()
+
+	if s.limiter != nil {
+		log.Printf("[%d] download rate %s", s.n, formatRate(s.rate))
+	}
+
+	s.useBehavior(cfg)
+	t = cfg.playtime(t, s.viewer.rnd)
+
+	end := time.Now().Add(time.Duration(t) * time.Second)
+	for {
+		playEntry(s, t, cfg)
+
+		t = int(end.Sub(time.Now()) / time.Second)
+		if !s.zap || t <= 0 || s.stopped() {
+			break
 		}
 
-		var subpl *m3u8.MediaPlaylist
-		var audiopl *m3u8.MediaPlaylist
+		s.zap = false
+		cfg = zapEntry(s, cfg)
+		s.useBehavior(cfg)
+		s.buffer.flush(time.Now(), "zap")
+		s.clock = newMediaClock(0)
+		log.Printf("[%d] zap to %s %s", s.n, cfg.serviceCode, cfg.fileName)
+	}
+
+	logSessionEnd(s)
+}
+
+// playEntry plays one generation info entry from the gslb request on.
+func playEntry(s *session, t int, cfg configInfo) {
+	n := s.n
+	s.info = cfg
+
+	s.info.destIP = s.bindIP(cfg)
 
-		if subplaylist != nil {
-			subpl = subplaylist.(*m3u8.MediaPlaylist)
+	client, err := newClient(s, s.info.destIP)
+	if err != nil {
+		s.logError(err)
+		return
+	}
+
+	var candidates []string
+	if s.useGSLB() {
+		info := gslbSetup{}
+
+		info.address = s.cfg.address
+		info.scheme = s.cfg.gslbScheme
+		info.ServiceCode = cfg.serviceCode
+		info.ClientIP = s.info.destIP
+		info.ProtocolType = s.cfg.scheme
+		info.ContentType = cfg.contentType
+		info.RequestBitrate = cfg.bitrateType
+		info.StreamingType = s.streamingType()
+
+		if strings.Contains(cfg.fileName, "/") {
+			info.Path = string(cfg.fileName[0:(strings.LastIndex(cfg.fileName, "/"))])
+			info.Content = string(cfg.fileName[(strings.LastIndex(cfg.fileName, "/"))+1 : len(cfg.fileName)])
+		} else {
+			info.Content = cfg.fileName
 		}
-		if audioplaylist != nil {
-			audiopl = audioplaylist.(*m3u8.MediaPlaylist)
+
+		s.gslbURL = info.scheme + "://" + info.address + "/command/demandOtu"
+		start := time.Now()
+		err = s.retry("gslb", func() error {
+			start = time.Now()
+			var err error
+			candidates, err = gslbsetup(&info, s.cfg.gslbClient)
+			return err
+		})
+		if err != nil {
+			s.fail("gslb")
+			s.logError(err)
+			return
 		}
 
-		for idx, segment := range mediapl.Segments {
-			start := time.Now()
-			if subpl != nil {
-				// sub download
-				subseg := subpl.Segments[idx]
-				if subseg != nil {
-					msURL, err := absolutize(subseg.URI, u)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
-					err = download(msURL, c, 0)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
-				}
-			}
+		stats.observe("gslb", time.Now().Sub(start))
+		s.gslbTime = time.Now().Sub(start)
+		log.Printf("[%d] gslb response time: %d ms", n, (int(time.Now().Sub(start)) / 1000000))
+	} else {
+		candidates = []string{s.cfg.scheme + "://" + s.cfg.address + "/" + cfg.serviceCode + "/" + cfg.fileName + "?AdaptiveType=" + strings.ToUpper(s.cfg.protocol)}
+	}
 
-			if audiopl != nil {
-				// audio download
-				audioseg := audiopl.Segments[idx]
-				if audioseg != nil {
-					msURL, err := absolutize(audioseg.URI, u)
-					if err != nil {
-						log.Println("error:", err)
-						return
-					}
-					err = download(msURL, c, 0)
+	if !s.cfg.failover {
+		candidates = candidates[:1]
+	}
+
+	s.client = client
+
+	content, url, err := openEntry(s, candidates)
+	if err != nil {
+		return
+	}
+
+	if s.cfg.protocol == protocolDASH {
+		err = playDash(s, content, url, t)
+		content.Close()
+		if err != nil {
+			s.logError(err)
+		}
+		return
+	}
+
+	playlist, listType, err := m3u8.DecodeFrom(content, true)
+	if err != nil {
+		s.fail("vod")
+		s.logError(err)
+		return
+	}
+	content.Close()
+
+	if listType != m3u8.MEDIA && listType != m3u8.MASTER {
+		s.fail("vod")
+		s.logError(fmt.Errorf("Not a valid playlist"))
+		return
+	}
+
+	if listType == m3u8.MASTER {
+		// HLS Adaptive
+		s.kind = "adaptive"
+		masterpl := playlist.(*m3u8.MasterPlaylist)
+		p, err := newPlayer(masterpl, s.cfg.abr, n)
+		if err != nil {
+			s.logError(err)
+			return
+		}
+		p.playback = s.buffer
+		getPlaylist(p, url, t, s)
+		log.Printf("[%d] abr %s: %d segments, %d switches", n, s.cfg.abr.strategy, p.segments, p.switches)
+	} else if listType == m3u8.MEDIA {
+		mediapl := playlist.(*m3u8.MediaPlaylist)
+		prepareSegments(mediapl)
+		if mediapl.Closed == false {
+			// HLS Live ( OTM Channel ). Static
+			s.kind = "static live"
+			log.Printf("[%d] Static Channel Session (OTM Channel)", n)
+			err = errNotLowLatency
+			if s.cfg.lowLatency {
+				err = playLowLatency(s, t, fixedURL(url), nil)
+			}
+			if err == errNotLowLatency {
+				err = playLive(s, t, s.cfg.liveDelay, mediapl, url, fixedURL(url), nil)
+			}
+			if err != nil {
+				s.logError(err)
+			}
+		} else {
+			// HLS VOD ( SKYLIFE Prime Movie Pack )
+			s.kind = "static vod"
+			log.Printf("[%d] Static VOD Session (Skylife Prime Movie Pack)", n)
+			for idx := 0; idx < len(mediapl.Segments); {
+				segment := mediapl.Segments[idx]
+				if segment != nil {
+					_, _, err = downloadSegment(segment, mediapl.SeqNo+uint64(idx), url, s, segment.Duration, "segment")
 					if err != nil {
-						log.Println("error:", err)
-						return
+						s.logError(err)
+						break
 					}
+					t -= int(segment.Duration)
+				} else {
+					break
 				}
-			}
 
-			// chunk download
-			if segment != nil {
-				msURL, err := absolutize(segment.URI, u)
-				if err != nil {
-					log.Println("error:", err)
-					return
+				if t <= 0 || s.stopped() {
+					break
 				}
-				err = download(msURL, c, segment.Duration)
-				if err != nil {
-					log.Println("error:", err)
-					return
+
+				next, zap := vodAction(s, mediapl, idx, segment.Duration)
+				if zap {
+					s.zap = true
+					break
 				}
-			} else {
-				return
+				idx = next
 			}
 
-			t -= int(int(time.Now().Sub(start)) / 1000000000)
-			if t <= 0 {
+		}
+
+	}
+}
+
+// openEntry sets up the gslb candidates in order until the glb and vod requests of one succeed.
+func openEntry(s *session, candidates []string) (io.ReadCloser, *url.URL, error) {
+	var phase string
+	var err error
+	for idx, candidate := range candidates {
+		if idx > 0 {
+			if s.stopped() {
 				break
 			}
+			s.failover(phase, candidate, err)
+		}
+
+		var content io.ReadCloser
+		var u *url.URL
+		content, u, phase, err = openCandidate(s, candidate)
+		if err == nil {
+			return content, u, nil
 		}
 	}
+
+	s.fail(phase)
+	s.logError(err)
+	return nil, nil, err
 }
 
-func main() {
+// openCandidate runs the glb and vod requests of one gslb url, it returns the phase that failed.
+func openCandidate(s *session, glburl string) (io.ReadCloser, *url.URL, string, error) {
+	theURL, err := url.Parse(glburl)
+	if err != nil {
+		return nil, nil, "glb", err
+	}
+	s.glbURL = theURL.String()
 
-	FileName := flag.String("filename", "", "generation info file path. mandatory")
-	Address := flag.String("addr", "", "server addresss. mandatory (ex) 127.0.0.1:18085")
-	SessionCount := flag.Int("count", 0, "the number of session. default is generation info file count")
-	Interval := flag.Int("interval", 1000, "session generation interval (millisecond)")
-	PlayTime := flag.Int("playtime", 900, "play time (second)")
-	StreamingType := flag.String("type", "static", "streaming type. adaptive or static")
-	UseGSLB := flag.Bool("gslb", true, "use gslb. true or false")
-	DisableKeepAlive := flag.Bool("disablekeepalive", false, "disable keepalive. true or false")
+	var vodURL *url.URL
+	start := time.Now()
+	err = s.retry("glb", func() error {
+		start = time.Now()
+		var err error
+		vodURL, err = glbSetup(theURL, s.client)
+		return err
+	})
+	if err != nil {
+		return nil, nil, "glb", err
+	}
+	stats.observe("glb", time.Now().Sub(start))
+	s.glbTime = time.Now().Sub(start)
+	s.vodURL = vodURL.String()
+	log.Printf("[%d] glb response time: %d ms", s.n, (int(time.Now().Sub(start)) / 1000000))
+
+	var content io.ReadCloser
+	var u *url.URL
+	start = time.Now()
+	err = s.retry("vod", func() error {
+		start = time.Now()
+		var err error
+		content, u, err = vodsetup(vodURL, s.client)
+		return err
+	})
+	if err != nil {
+		return nil, nil, "vod", err
+	}
+	stats.observe("vod", time.Now().Sub(start))
+	s.vodTime = time.Now().Sub(start)
+	log.Printf("[%d] vod response time: %d ms", s.n, (int(time.Now().Sub(start)) / 1000000))
 
-	flag.Parse()
+	return content, u, "", nil
+}
 
-	if *FileName == "" || *Address == "" {
-		log.Println("HLSGenerator v1.0.8")
-		flag.Usage()
-		return
+func logSessionEnd(s *session) {
+	if s.cfg.validate {
+		log.Printf("[%d] validation: %d segments, %d corrupt", s.n, s.segments, s.corrupt)
+	}
+	if s.cfg.decrypt {
+		log.Printf("[%d] decryption: %d keys, %d failed", s.n, len(s.keys), s.decryptFailed)
+	}
+	if s.dnsLookups > 0 {
+		log.Printf("[%d] dns: %d lookups, %d ms average", s.n, s.dnsLookups, int(s.dnsTime/time.Duration(s.dnsLookups))/1000000)
 	}
+	if s.newConns > 0 {
+		log.Printf("[%d] connections: %d new, %d requests reused one", s.n, s.newConns, s.reusedConns)
+	}
+	if s.tlsHandshakes > 0 {
+		log.Printf("[%d] tls: %d handshakes, %d ms average", s.n, s.tlsHandshakes, int(s.tlsTime/time.Duration(s.tlsHandshakes))/1000000)
+	}
+	log.Printf("[%d] Session End", s.n)
+}
 
-	configData, err := ioutil.ReadFile(*FileName)
+// entryPool returns the pool of a ClientIP range, shared by the entries with the same
+// range and allocated by alloc. it is nil for a single address.
+func entryPool(pools map[string]*ipPool, destIP string, alloc string) (*ipPool, error) {
+	if !isIPPool(destIP) {
+		return nil, nil
+	}
+	pool, ok := pools[destIP]
+	if !ok {
+		var err error
+		if pool, err = newIPPool(destIP, alloc); err != nil {
+			return nil, err
+		}
+		pools[destIP] = pool
+	}
+	return pool, nil
+}
+
+// readConfig reads the generation info file, one entry of five columns per line
+// or a yaml or json scenario.
+func readConfig(fileName string, alloc string) ([]configInfo, error) {
+	configData, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Println("config file read file: ", err)
-		return
+		return nil, err
+	}
+
+	if isScenario(configData) {
+		return parseScenario(configData, alloc)
 	}
 
 	cfData := string(configData)
@@ -472,6 +924,7 @@ func main() {
 	token := strings.Split(cfData, "\n")
 
 	var cfglist []configInfo
+	pools := make(map[string]*ipPool)
 
 	i := 0
 	for i < len(token) {
@@ -490,223 +943,381 @@ func main() {
 			cfg.contentType = data[3]
 			cfg.bitrateType = data[4]
 
+			if cfg.pool, err = entryPool(pools, cfg.destIP, alloc); err != nil {
+				log.Println("invalid config data : ", token[i], err)
+				i++
+				continue
+			}
+
 			cfglist = append(cfglist, cfg)
 		}
 		i++
 	}
 
-	if len(cfglist) == 0 {
-		log.Println("cfglist is zero.")
+	return cfglist, nil
+}
+
+func main() {
+
+	FileName := flag.String("filename", "", "generation info file path, five column text or a yaml or json scenario. mandatory")
+	Address := flag.String("addr", "", "server addresss. mandatory (ex) 127.0.0.1:18085")
+	SessionCount := flag.Int("count", 0, "the number of session. default is generation info file count")
+	Interval := flag.Int("interval", 1000, "session generation interval (millisecond)")
+	Profile := flag.String("profile", "", "load profile instead of count and interval. optional (ex) ramp:3000:10m,hold:30m,ramp:0:5m")
+	ProfileFile := flag.String("profile-file", "", "load profile file path, one stage per line. optional")
+	PlayTime := flag.Int("playtime", 900, "play time (second)")
+	StreamingType := flag.String("type", "static", "streaming type. adaptive or static")
+	Protocol := flag.String("protocol", protocolHLS, "streaming protocol. hls or dash")
+	UseGSLB := flag.Bool("gslb", true, "use gslb. true or false")
+	DisableKeepAlive := flag.Bool("disablekeepalive", false, "disable keepalive. true or false")
+	LiveDelay := flag.Int("live-delay", 3, "live start position in segments behind the live edge")
+	BufferTarget := flag.Float64("buffer", 0, "seconds the client keeps buffered. 0 keeps one segment ahead of playback")
+	BufferStartup := flag.Float64("buffer-startup", 0, "seconds buffered before playback starts. 0 starts after the first segment")
+	Decrypt := flag.Bool("decrypt", false, "decrypt AES-128 segments and check the plaintext. true or false")
+	Validate := flag.Bool("validate", false, "validate segment content (size, ts sync bytes, mp4 boxes). true or false")
+	ABRStrategy := flag.String("abr", "none", "adaptive bitrate switching. none, throughput, buffer or random")
+	ABRInterval := flag.Int("abr-interval", 10, "random switching: switch variant every N segments")
+	ABRSafety := flag.Float64("abr-safety", 0.8, "throughput switching: fraction of the measured throughput a variant may use")
+	ABRBufferLow := flag.Float64("abr-buffer-low", 5, "buffer switching: buffer seconds below which the lowest variant is used")
+	ABRBufferHigh := flag.Float64("abr-buffer-high", 20, "buffer switching: buffer seconds above which the highest variant is used")
+	MetricsAddr := flag.String("metrics-addr", "", "prometheus metrics listen address. optional (ex) :9100")
+	AudioLang := flag.String("audio-lang", "", "audio rendition language. default is the DEFAULT rendition, none disables audio renditions")
+	AudioGroup := flag.String("audio-group", "", "audio rendition GROUP-ID. default is the group of the variant")
+	SubtitleLang := flag.String("subtitle-lang", "", "subtitle rendition language. default is the DEFAULT rendition, none disables subtitles")
+	SubtitleGroup := flag.String("subtitle-group", "", "subtitle rendition GROUP-ID. default is the group of the variant")
+	Behavior := flag.String("behavior", "", "viewer script of hls sessions. optional (ex) play:30s,seek:random,pause:10s,play:1m,zap")
+	BehaviorFile := flag.String("behavior-file", "", "viewer script file path, one step per line. optional")
+	BehaviorRandom := flag.String("behavior-random", "", "viewer action chances per segment, after the script. optional (ex) seek:0.05,pause:0.02:10s,zap:0.01")
+	Replay := flag.String("replay", "", "session trace file path to replay instead of the generation info file. optional")
+	ReplayScale := flag.Float64("replay-scale", 1, "replay time scale. 0.5 replays twice as fast, 2 half as fast")
+	GSLBScheme := flag.String("gslb-scheme", "http", "gslb request scheme. http or https")
+	Scheme := flag.String("scheme", "http", "glb and content request scheme without gslb, protocol type sent to gslb. http or https")
+	CAFile := flag.String("ca-file", "", "CA bundle file path to verify https servers. default is the system roots")
+	CertFile := flag.String("cert-file", "", "client certificate file path for https. optional")
+	KeyFile := flag.String("key-file", "", "client certificate key file path for https. optional")
+	Insecure := flag.Bool("insecure", false, "skip https certificate verification. true or false")
+	HTTP2 := flag.Bool("http2", false, "use HTTP/2 over https when the server supports it. true or false")
+	Grace := flag.Int("grace", 10, "seconds running sessions get to finish their current segment after SIGINT or SIGTERM")
+	ResultFile := flag.String("results", "", "per session result file path. optional")
+	ResultFormat := flag.String("results-format", "jsonl", "per session result format. jsonl or csv")
+	ReportFile := flag.String("report", "", "latency summary json file path. optional")
+	LowLatency := flag.Bool("llhls", false, "play LL-HLS live playlists by parts with blocking reloads and preload hints. true or false")
+	DNSServer := flag.String("dns-server", "", "dns server address to resolve host names with. default is the system resolver (ex) 127.0.0.1:5353")
+	Resolve := flag.String("resolve", "", "host:port:ip overrides of host name resolution like curl --resolve. optional (ex) edge.example.com:80:10.0.0.1")
+	Rate := flag.String("rate", "", "download rate cap per session in bits per second, fixed or shares of sessions. optional (ex) 3M or 30%:3M,50%:8M,20%:unlimited")
+	Retry := flag.String("retry", "", "retries of failed requests per phase as phase:retries[:backoff], all sets every phase. optional (ex) all:2,segment:3:500ms")
+	RetryMaxBackoff := flag.Duration("retry-max-backoff", 5*time.Second, "upper limit of the doubling retry backoff")
+	Failover := flag.Bool("failover", true, "try the next gslb oneTimeUrl when glb or vod fail. true or false")
+	IPPool := flag.String("ip-pool", "", "local bind addresses for all entries instead of the ClientIP column, CIDRs or ranges. optional (ex) 10.1.0.0/20,10.2.0.1-10.2.0.100")
+	IPAlloc := flag.String("ip-alloc", allocRoundRobin, "ip pool allocation of a distinct address per session. round-robin or random")
+	AgentListen := flag.String("agent-listen", "", "run as agent and wait for coordinator jobs on this address, a trusted interface only. optional (ex) 10.0.0.5:9200")
+	AgentToken := flag.String("agent-token", "", "shared secret the coordinator sends and agents require. optional")
+	Agents := flag.String("agents", "", "run as coordinator and split the run across these agents. optional (ex) host1:9200,host2:9200")
+	SessionOffset := flag.Int("session-offset", 0, "number of the first session, set by the coordinator")
+	SessionStep := flag.Int("session-step", 1, "session number step, set by the coordinator")
+	StartAt := flag.Int64("start-at", 0, "unix time in milliseconds to start the first session at, set by the coordinator")
+	Select := flag.String("select", "", "content selection. round-robin, weighted or zipf. default is weighted when scenario entries have weights, else round-robin")
+	ZipfS := flag.Float64("zipf-s", 1, "zipf selection: popularity exponent, the entry of rank k in file order gets 1/k^s of the sessions")
+	Seed := flag.Int64("seed", 0, "weighted and zipf selection: random seed to reproduce the content of every session. 0 draws from the clock")
+	StatsDump := flag.String("stats-dump", "", "latency and qoe histogram file path for the coordinator, set by the agent")
+
+	flag.Parse()
+
+	if *AgentListen != "" {
+		if err := serveAgent(*AgentListen, *AgentToken); err != nil {
+			log.Println("agent: ", err)
+		}
 		return
 	}
 
-	if *SessionCount == 0 {
-		*SessionCount = len(cfglist)
+	if (*FileName == "" && *Replay == "") || *Address == "" {
+		log.Println("HLSGenerator v1.0.8")
+		flag.Usage()
+		return
 	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	var err error
+
+	var stages []loadStage
+	if *Profile != "" {
+		stages, err = parseProfile(*Profile)
+	} else if *ProfileFile != "" {
+		stages, err = readProfile(*ProfileFile)
+	}
+	if err != nil {
+		log.Println("load profile: ", err)
+		return
+	}
+
+	var behavior *behaviorConfig
+	if *Behavior != "" || *BehaviorFile != "" || *BehaviorRandom != "" {
+		behavior = &behaviorConfig{}
+		if *Behavior != "" {
+			behavior.script, err = parseScript(*Behavior)
+		} else if *BehaviorFile != "" {
+			behavior.script, err = readScript(*BehaviorFile)
+		}
+		if err == nil && *BehaviorRandom != "" {
+			behavior.random, err = parseRandomBehavior(*BehaviorRandom)
+		}
+		if err != nil {
+			log.Println("viewer behavior: ", err)
+			return
+		}
+	}
 
-	wg := new(sync.WaitGroup)
+	for _, scheme := range []string{*GSLBScheme, *Scheme} {
+		if scheme != "http" && scheme != "https" {
+			log.Println("invalid scheme : ", scheme)
+			return
+		}
+	}
 
-	// test
-	for i := 0; i < *SessionCount; i++ {
-		wg.Add(1)
-		go func(t int, n int) {
-			defer wg.Done()
-			num := n
+	tlsConfig, err := loadTLSConfig(*CAFile, *CertFile, *KeyFile, *Insecure, *HTTP2)
+	if err != nil {
+		log.Println("tls config: ", err)
+		return
+	}
 
-			if num >= len(cfglist) {
-				num %= len(cfglist)
-			}
+	if *ResultFormat != resultJSONL && *ResultFormat != resultCSV {
+		log.Println("invalid results format : ", *ResultFormat)
+		return
+	}
 
-			localAddr, err := net.ResolveIPAddr("ip", cfglist[num].destIP)
-			if err != nil {
-				log.Printf("[%d] error: %s", i, err)
-				return
-			}
+	if *ReplayScale <= 0 {
+		log.Println("replay-scale must be positive")
+		return
+	}
 
-			LocalBindAddr := &net.TCPAddr{IP: localAddr.IP}
+	if *IPAlloc != allocRoundRobin && *IPAlloc != allocRandom {
+		log.Println("invalid ip allocation : ", *IPAlloc)
+		return
+	}
 
-			var glburl string
-			if *UseGSLB {
-				info := gslbSetup{}
+	var ipPoolAll *ipPool
+	if *IPPool != "" {
+		if ipPoolAll, err = newIPPool(*IPPool, *IPAlloc); err != nil {
+			log.Println("ip pool: ", err)
+			return
+		}
+	}
 
-				info.address = *Address
-				info.ServiceCode = cfglist[num].serviceCode
-				info.ClientIP = cfglist[num].destIP
-				info.ProtocolType = "http"
-				info.ContentType = cfglist[num].contentType
-				info.RequestBitrate = cfglist[num].bitrateType
-				info.StreamingType = *StreamingType
+	retry := make(map[string]retryPolicy)
+	if *Retry != "" {
+		if retry, err = parseRetry(*Retry); err != nil {
+			log.Println("retry: ", err)
+			return
+		}
+	}
 
-				if strings.Contains(cfglist[num].fileName, "/") {
-					info.Path = string(cfglist[num].fileName[0:(strings.LastIndex(cfglist[num].fileName, "/"))])
-					info.Content = string(cfglist[num].fileName[(strings.LastIndex(cfglist[num].fileName, "/"))+1 : len(cfglist[num].fileName)])
-				} else {
-					info.Content = cfglist[num].fileName
-				}
+	var rates []rateClass
+	if *Rate != "" {
+		if rates, err = parseRates(*Rate); err != nil {
+			log.Println("rate: ", err)
+			return
+		}
+	}
 
-				start := time.Now()
-				glburl, err = gslbsetup(&info)
-				if err != nil {
-					log.Printf("[%d] error: %s", n, err)
-					return
-				}
+	var overrides map[string]string
+	if *Resolve != "" {
+		if overrides, err = parseResolve(*Resolve); err != nil {
+			log.Println("resolve: ", err)
+			return
+		}
+	}
 
-				log.Printf("[%d] gslb response time: %d ms", n, (int(time.Now().Sub(start)) / 1000000))
-			} else {
-				glburl = "http://" + *Address + "/" + cfglist[num].serviceCode + "/" + cfglist[num].fileName + "?AdaptiveType=HLS"
-			}
+	if *LiveDelay < 0 {
+		log.Println("live-delay must not be negative")
+		return
+	}
 
-			theURL, err := url.Parse(glburl)
-			if err != nil {
-				log.Printf("[%d] error: %s", n, err)
-				return
-			}
+	if *SessionStep < 1 {
+		log.Println("session-step must be positive")
+		return
+	}
 
-			var httpTransport = &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				Dial: (&net.Dialer{
-					LocalAddr: LocalBindAddr,
-					Timeout:   5 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).Dial,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-				//Android
-				DisableKeepAlives: *DisableKeepAlive,
-			}
+	if *Protocol != protocolHLS && *Protocol != protocolDASH {
+		log.Println("invalid protocol : ", *Protocol)
+		return
+	}
 
-			client := &http.Client{
-				Transport: httpTransport,
-				Timeout:   5 * time.Second,
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				},
-			}
+	if !validABRStrategy(*ABRStrategy) {
+		log.Println("invalid abr strategy : ", *ABRStrategy)
+		return
+	}
 
-			start := time.Now()
-			url, err := glbSetup(theURL, client)
-			if err != nil {
-				log.Printf("[%d] error: %s", n, err)
-				return
-			}
-			log.Printf("[%d] glb response time: %d ms", n, (int(time.Now().Sub(start)) / 1000000))
+	if *ABRStrategy == abrBuffer && *ABRBufferHigh <= *ABRBufferLow {
+		log.Println("abr-buffer-high must be greater than abr-buffer-low")
+		return
+	}
 
-			start = time.Now()
-			content, url, err := vodsetup(url, client)
-			if err != nil {
-				log.Printf("[%d] error: %s", n, err)
-				return
-			}
-			log.Printf("[%d] vod response time: %d ms", n, (int(time.Now().Sub(start)) / 1000000))
+	sc := &sessionConfig{
+		address:          *Address,
+		streamingType:    *StreamingType,
+		protocol:         *Protocol,
+		useGSLB:          *UseGSLB,
+		disableKeepAlive: *DisableKeepAlive,
+		validate:         *Validate,
+		decrypt:          *Decrypt,
+		liveDelay:        *LiveDelay,
+		bufferTarget:     *BufferTarget,
+		bufferStartup:    *BufferStartup,
+		abr: &abrConfig{
+			strategy:   *ABRStrategy,
+			interval:   *ABRInterval,
+			safety:     *ABRSafety,
+			bufferLow:  *ABRBufferLow,
+			bufferHigh: *ABRBufferHigh,
+		},
+		audio:      renditionSelect{lang: *AudioLang, group: *AudioGroup},
+		subtitles:  renditionSelect{lang: *SubtitleLang, group: *SubtitleGroup},
+		behavior:   behavior,
+		scheme:     *Scheme,
+		gslbScheme: *GSLBScheme,
+		tls:        tlsConfig,
+		http2:      *HTTP2,
+		ipPool:     ipPoolAll,
+
+		retry:           retry,
+		retryMaxBackoff: *RetryMaxBackoff,
+		failover:        *Failover,
+		rates:           rates,
+		resolver:        newHostResolver(*DNSServer, overrides),
+		lowLatency:      *LowLatency,
+	}
+	sc.gslbClient = newGSLBClient(sc)
+
+	var cfglist []configInfo
+	var selector *contentSelector
+	var traces []*traceSession
+	if *Replay != "" {
+		traces, err = readTrace(*Replay)
+		if err != nil {
+			log.Println("replay trace: ", err)
+			return
+		}
+	} else {
+		cfglist, err = readConfig(*FileName, *IPAlloc)
+		if err != nil {
+			log.Println("config file read file: ", err)
+			return
+		}
+
+		if len(cfglist) == 0 {
+			log.Println("cfglist is zero.")
+			return
+		}
+
+		if *SessionCount == 0 {
+			*SessionCount = len(cfglist)
+		}
+
+		if selector, err = newContentSelector(cfglist, *Select, *ZipfS, *Seed); err != nil {
+			log.Println("content selection: ", err)
+			return
+		}
+	}
+
+	sc.entries = cfglist
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if *MetricsAddr != "" {
+		serveMetrics(*MetricsAddr)
+	}
+
+	handleSignals(time.Duration(*Grace) * time.Second)
+
+	if *ResultFile != "" {
+		if err := results.open(*ResultFile, *ResultFormat); err != nil {
+			log.Println("results: ", err)
+			return
+		}
+		defer results.close()
+	}
 
-			playlist, listType, err := m3u8.DecodeFrom(content, true)
+	if *StartAt > 0 {
+		control.sleep(time.Until(time.Unix(0, *StartAt*int64(time.Millisecond))))
+	}
+
+	if *Agents != "" {
+		c := &coordinatorRun{
+			agents:   strings.Split(*Agents, ","),
+			count:    *SessionCount,
+			interval: *Interval,
+			stages:   stages,
+			traces:   traces,
+			scale:    *ReplayScale,
+			token:    *AgentToken,
+		}
+		if traces == nil {
+			config, err := ioutil.ReadFile(*FileName)
 			if err != nil {
-				log.Printf("[%d] error: %s", n, err)
+				log.Println("config file read file: ", err)
 				return
 			}
-			content.Close()
-
-			if listType != m3u8.MEDIA && listType != m3u8.MASTER {
-				log.Printf("[%d] error: Not a valid playlist", n)
+			c.config = string(config)
+		}
+		if *BehaviorFile != "" {
+			script, err := ioutil.ReadFile(*BehaviorFile)
+			if err != nil {
+				log.Println("viewer behavior: ", err)
 				return
 			}
+			c.behavior = string(script)
+		}
+		runCoordinator(c)
+	} else if traces != nil {
+		runReplay(traces, *ReplayScale, *SessionOffset, *SessionStep, sc)
+	} else if stages != nil {
+		runProfile(stages, func(i int) *session {
+			return newSession(*SessionOffset+i**SessionStep, sc)
+		}, func(s *session) {
+			runSession(s, *PlayTime, selector.pick(s.n))
+		})
+	} else {
+		wg := new(sync.WaitGroup)
 
-			if listType == m3u8.MASTER {
-				// HLS Adaptive
-				masterpl := playlist.(*m3u8.MasterPlaylist)
-				for _, variant := range masterpl.Variants {
-					if variant != nil {
-						getPlaylist(variant, url, t, client, n)
-						break
-					}
-				}
-			} else if listType == m3u8.MEDIA {
-				mediapl := playlist.(*m3u8.MediaPlaylist)
-				if mediapl.Closed == false {
-					// HLS Live ( OTM Channel ). Static
-					log.Printf("[%d] Static Channel Session (OTM Channel)", n)
-					for t > 0 {
-						content, _, err := getContent(url, client)
-						if err != nil {
-							log.Println("error:", err)
-							break
-						}
-
-						playlist, listType, err := m3u8.DecodeFrom(content, true)
-						if err != nil {
-							log.Println("error:", err)
-							break
-						}
-						content.Close()
-
-						if listType != m3u8.MEDIA && listType != m3u8.MASTER {
-							log.Println("error: Not a valid playlist")
-							break
-						}
-
-						if listType == m3u8.MEDIA {
-							mediapl := playlist.(*m3u8.MediaPlaylist)
-							for idx, segment := range mediapl.Segments {
-								if idx > 0 {
-									if segment == nil {
-										chunk := mediapl.Segments[idx-1]
-										if chunk != nil {
-											msURL, err := absolutize(chunk.URI, url)
-											if err != nil {
-												log.Println("error:", err)
-												break
-											}
-											err = download(msURL, client, chunk.Duration)
-											if err != nil {
-												log.Println("error:", err)
-												break
-											}
-											t -= int(chunk.Duration)
-											break
-										}
-									}
-								}
-							}
-						} else {
-							log.Println("error: invaild m3u8 Type")
-							break
-						}
-					}
-				} else {
-					// HLS VOD ( SKYLIFE Prime Movie Pack )
-					log.Printf("[%d] Static VOD Session (Skylife Prime Movie Pack)", n)
-					for _, segment := range mediapl.Segments {
-						if segment != nil {
-							msURL, err := absolutize(segment.URI, url)
-							if err != nil {
-								log.Printf("[%d] error: %s", n, err)
-								break
-							}
-							err = download(msURL, client, segment.Duration)
-							if err != nil {
-								log.Println("error:", err)
-								break
-							}
-							t -= int(segment.Duration)
-						} else {
-							break
-						}
-
-						if t <= 0 {
-							break
-						}
-					}
+		// test
+		for i := 0; i < *SessionCount && !control.stopped(); i++ {
+			wg.Add(1)
+			go func(t int, n int) {
+				defer wg.Done()
+				runSession(newSession(n, sc), t, selector.pick(n))
+			}(*PlayTime, *SessionOffset+i**SessionStep)
 
-				}
+			control.sleep(time.Duration(*Interval * 1000000))
+		}
+		control.wait(wg)
+	}
 
-			}
-			log.Printf("[%d] Session End", n)
-		}(*PlayTime, i)
+	if control.stopped() {
+		log.Println("interrupted, partial results")
+	}
 
-		time.Sleep(time.Duration(*Interval * 1000000))
+	reports := stats.report()
+	printReport(reports)
+	qoe.print()
+	recovery.print()
+	requestTimings.print()
+	if selector != nil {
+		selector.print()
+	}
+	if *Validate {
+		validation.print()
+	}
+	if *Decrypt {
+		decryption.print()
+	}
+	if *ReportFile != "" {
+		if err := writeReport(*ReportFile, reports); err != nil {
+			log.Println("error:", err)
+		}
+	}
+	if *StatsDump != "" {
+		if err := writeStatsDump(*StatsDump); err != nil {
+			log.Println("error:", err)
+		}
 	}
-	wg.Wait()
 	log.Println("the all end")
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// bitrate switching strategies
+const (
+	abrNone       = "none"
+	abrThroughput = "throughput"
+	abrBuffer     = "buffer"
+	abrRandom     = "random"
+)
+
+type abrConfig struct {
+	strategy   string
+	interval   int     // random: switch every interval segments
+	safety     float64 // throughput: fraction of the estimated throughput a variant may use
+	bufferLow  float64 // buffer: below this many seconds the lowest variant is used
+	bufferHigh float64 // buffer: above this many seconds the highest variant is used
+}
+
+func validABRStrategy(s string) bool {
+	switch s {
+	case abrNone, abrThroughput, abrBuffer, abrRandom:
+		return true
+	}
+	return false
+}
+
+// player models the variant selection of an adaptive client
+type player struct {
+	n         int
+	cfg       *abrConfig
+	ladder    []uint32        // ascending bandwidth
+	variants  []*m3u8.Variant // HLS variants in ladder order
+	current   int
+	estimate  float64 // bits per second, moving average of measured segment throughput
+	buffer    float64 // buffered seconds, of playback when set, else estimated from download times
+	playback  *playbackBuffer
+	segments  int
+	switches  int
+	playlists map[int]*m3u8.MediaPlaylist
+	rnd       *rand.Rand
+}
+
+// newLadderPlayer creates a player over ascending bandwidths starting at index first.
+func newLadderPlayer(ladder []uint32, first int, cfg *abrConfig, n int) *player {
+	return &player{
+		n:         n,
+		cfg:       cfg,
+		ladder:    ladder,
+		current:   first,
+		playlists: make(map[int]*m3u8.MediaPlaylist),
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano() + int64(n))),
+	}
+}
+
+func newPlayer(masterpl *m3u8.MasterPlaylist, cfg *abrConfig, n int) (*player, error) {
+	var variants []*m3u8.Variant
+	var first *m3u8.Variant
+	for _, variant := range masterpl.Variants {
+		if variant == nil || variant.Iframe {
+			continue
+		}
+		if first == nil {
+			first = variant
+		}
+		variants = append(variants, variant)
+	}
+
+	if first == nil {
+		return nil, fmt.Errorf("no variant in master playlist")
+	}
+
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].Bandwidth < variants[j].Bandwidth
+	})
+
+	// start with the first listed variant like the players do
+	var ladder []uint32
+	current := 0
+	for idx, variant := range variants {
+		if variant == first {
+			current = idx
+		}
+		ladder = append(ladder, variant.Bandwidth)
+	}
+
+	p := newLadderPlayer(ladder, current, cfg, n)
+	p.variants = variants
+	return p, nil
+}
+
+func (p *player) variant() *m3u8.Variant {
+	return p.variants[p.current]
+}
+
+// playlist returns the media playlist of the current variant, fetching it once per variant.
+func (p *player) playlist(u *url.URL, s *session) (*m3u8.MediaPlaylist, *url.URL, error) {
+	msURL, err := absolutize(p.variant().URI, u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mediapl, ok := p.playlists[p.current]; ok {
+		return mediapl, msURL, nil
+	}
+
+	mediapl, err := getMediaPlaylist(msURL, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.playlists[p.current] = mediapl
+	return mediapl, msURL, nil
+}
+
+// update feeds a finished segment download into the throughput and buffer estimates.
+func (p *player) update(size int64, elapsed time.Duration, duration float64) {
+	p.segments++
+
+	if elapsed > 0 {
+		bps := float64(size*8) / elapsed.Seconds()
+		if p.estimate == 0 {
+			p.estimate = bps
+		} else {
+			p.estimate = 0.7*p.estimate + 0.3*bps
+		}
+	}
+
+	if p.playback != nil {
+		// the buffer switching sees the level the stalls are reported from
+		p.playback.advance(time.Now())
+		p.buffer = p.playback.level
+		return
+	}
+
+	p.buffer += duration - elapsed.Seconds()
+	if p.buffer < 0 {
+		p.buffer = 0
+	}
+	if p.buffer > p.cfg.bufferHigh {
+		p.buffer = p.cfg.bufferHigh
+	}
+}
+
+// next chooses the variant for the next segment and reports whether it changed.
+func (p *player) next() bool {
+	target := p.current
+
+	switch p.cfg.strategy {
+	case abrThroughput:
+		if p.estimate == 0 {
+			break
+		}
+		target = 0
+		for idx, bandwidth := range p.ladder {
+			if float64(bandwidth) <= p.estimate*p.cfg.safety {
+				target = idx
+			}
+		}
+	case abrBuffer:
+		top := len(p.ladder) - 1
+		switch {
+		case p.buffer <= p.cfg.bufferLow:
+			target = 0
+		case p.buffer >= p.cfg.bufferHigh:
+			target = top
+		default:
+			ratio := (p.buffer - p.cfg.bufferLow) / (p.cfg.bufferHigh - p.cfg.bufferLow)
+			target = int(ratio * float64(top))
+		}
+	case abrRandom:
+		if p.cfg.interval > 0 && p.segments%p.cfg.interval == 0 {
+			target = p.rnd.Intn(len(p.ladder))
+		}
+	}
+
+	if target == p.current {
+		return false
+	}
+
+	log.Printf("[%d] abr switch %d -> %d bps (estimate %.0f bps, buffer %.1f s)", p.n, p.ladder[p.current], p.ladder[target], p.estimate, p.buffer)
+	p.current = target
+	p.switches++
+	return true
+}
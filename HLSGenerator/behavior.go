@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// viewer actions
+const (
+	actionPlay  = "play"
+	actionSeek  = "seek"
+	actionPause = "pause"
+	actionZap   = "zap"
+)
+
+// behaviorStep is one viewer action.
+// in a script play lasts duration seconds of media, pause lasts duration and
+// seek jumps to position. in a random behavior each action has a chance per segment.
+type behaviorStep struct {
+	kind     string
+	chance   float64
+	duration time.Duration
+	position string // seek: random, NN% or a time offset
+}
+
+type behaviorConfig struct {
+	script []behaviorStep
+	random []behaviorStep
+}
+
+func splitSteps(text string) []string {
+	var steps []string
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		steps = append(steps, field)
+	}
+	return steps
+}
+
+func validSeekPosition(position string) bool {
+	if position == "random" {
+		return true
+	}
+	if strings.HasSuffix(position, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(position, "%"), 64)
+		return err == nil && percent >= 0 && percent <= 100
+	}
+	d, err := time.ParseDuration(position)
+	return err == nil && d >= 0
+}
+
+// parseScript parses viewer actions in order, e.g.
+// "play:30s, seek:random, pause:10s, play:1m, seek:50%, zap".
+func parseScript(text string) ([]behaviorStep, error) {
+	var steps []behaviorStep
+	for _, field := range splitSteps(text) {
+		data := strings.Split(field, ":")
+		step := behaviorStep{kind: strings.TrimSpace(data[0])}
+
+		switch {
+		case (step.kind == actionPlay || step.kind == actionPause) && len(data) == 2:
+			d, err := time.ParseDuration(strings.TrimSpace(data[1]))
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid behavior duration : %s", field)
+			}
+			step.duration = d
+		case step.kind == actionSeek && len(data) == 2:
+			step.position = strings.TrimSpace(data[1])
+			if !validSeekPosition(step.position) {
+				return nil, fmt.Errorf("invalid seek position : %s", field)
+			}
+		case step.kind == actionZap && len(data) == 1:
+		default:
+			return nil, fmt.Errorf("invalid behavior step : %s", field)
+		}
+
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty behavior script")
+	}
+	return steps, nil
+}
+
+// parseRandomBehavior parses per segment action chances, e.g.
+// "seek:0.05, pause:0.02:10s, zap:0.01". seeks go to a random segment.
+func parseRandomBehavior(text string) ([]behaviorStep, error) {
+	var steps []behaviorStep
+	for _, field := range splitSteps(text) {
+		data := strings.Split(field, ":")
+		step := behaviorStep{kind: strings.TrimSpace(data[0]), position: "random"}
+
+		switch {
+		case step.kind == actionPause && len(data) == 3:
+			d, err := time.ParseDuration(strings.TrimSpace(data[2]))
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid behavior duration : %s", field)
+			}
+			step.duration = d
+		case (step.kind == actionSeek || step.kind == actionZap) && len(data) == 2:
+		default:
+			return nil, fmt.Errorf("invalid behavior step : %s", field)
+		}
+
+		chance, err := strconv.ParseFloat(strings.TrimSpace(data[1]), 64)
+		if err != nil || chance < 0 || chance > 1 {
+			return nil, fmt.Errorf("invalid behavior chance : %s", field)
+		}
+		step.chance = chance
+
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty random behavior")
+	}
+	return steps, nil
+}
+
+func readScript(fileName string) ([]behaviorStep, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseScript(string(data))
+}
+
+// viewer runs the behavior of one session
+type viewer struct {
+	cfg    *behaviorConfig
+	step   int
+	played float64 // media seconds played in the current play step
+	rnd    *rand.Rand
+}
+
+func newViewer(cfg *behaviorConfig, n int) *viewer {
+	return &viewer{
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano() + int64(n))),
+	}
+}
+
+// next is called after each main track segment of duration seconds
+// and returns the action to take, play continues normally.
+func (v *viewer) next(duration float64) behaviorStep {
+	if v.cfg == nil {
+		return behaviorStep{kind: actionPlay}
+	}
+
+	for v.step < len(v.cfg.script) {
+		step := v.cfg.script[v.step]
+		if step.kind != actionPlay {
+			v.step++
+			return step
+		}
+
+		v.played += duration
+		duration = 0
+		if v.played < step.duration.Seconds() {
+			return behaviorStep{kind: actionPlay}
+		}
+		v.played = 0
+		v.step++
+	}
+
+	for _, step := range v.cfg.random {
+		if v.rnd.Float64() < step.chance {
+			return step
+		}
+	}
+	return behaviorStep{kind: actionPlay}
+}
+
+// seekIndex returns the segment of mediapl at the seek position of step.
+func (v *viewer) seekIndex(step behaviorStep, mediapl *m3u8.MediaPlaylist) int {
+	var total float64
+	count := 0
+	for _, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		total += segment.Duration
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+
+	var position float64
+	switch {
+	case step.position == "random":
+		return v.rnd.Intn(count)
+	case strings.HasSuffix(step.position, "%"):
+		percent, _ := strconv.ParseFloat(strings.TrimSuffix(step.position, "%"), 64)
+		position = total * percent / 100
+	default:
+		d, _ := time.ParseDuration(step.position)
+		position = d.Seconds()
+	}
+
+	var start float64
+	for idx := 0; idx < count; idx++ {
+		start += mediapl.Segments[idx].Duration
+		if start > position {
+			return idx
+		}
+	}
+	return count - 1
+}
+
+// segmentStart returns the media time at which segment idx of mediapl starts.
+func segmentStart(mediapl *m3u8.MediaPlaylist, idx int) float64 {
+	var start float64
+	for i := 0; i < idx && i < len(mediapl.Segments); i++ {
+		if mediapl.Segments[i] == nil {
+			break
+		}
+		start += mediapl.Segments[i].Duration
+	}
+	return start
+}
+
+// pause stops playback for d, the buffer does not drain meanwhile.
+func pause(s *session, d time.Duration) {
+	log.Printf("[%d] pause %v", s.n, d)
+	s.buffer.hold(time.Now(), true)
+	s.sleep(d)
+	s.buffer.hold(time.Now(), false)
+}
+
+// vodAction applies the viewer action after segment idx of a VOD playlist.
+// it returns the index of the next segment and whether the viewer zaps away.
+func vodAction(s *session, mediapl *m3u8.MediaPlaylist, idx int, duration float64) (int, bool) {
+	step := s.viewer.next(duration)
+	switch step.kind {
+	case actionPause:
+		pause(s, step.duration)
+	case actionSeek:
+		target := s.viewer.seekIndex(step, mediapl)
+		log.Printf("[%d] seek from segment %d to %d", s.n, idx+1, target)
+		s.buffer.flush(time.Now(), "seek")
+		return target, false
+	case actionZap:
+		return idx + 1, true
+	}
+	return idx + 1, false
+}
+
+// zapEntry picks another generation info entry than cfg to zap to, by weight when the entries have weights.
+func zapEntry(s *session, cfg configInfo) configInfo {
+	var others []configInfo
+	for _, entry := range s.cfg.entries {
+		if entry != cfg {
+			others = append(others, entry)
+		}
+	}
+	if len(others) == 0 {
+		return cfg
+	}
+	return pickWeighted(others, s.viewer.rnd)
+}
+
+// useBehavior switches the viewer to the behavior of cfg when it has its own one,
+// back to the run wide behavior when it does not.
+func (s *session) useBehavior(cfg configInfo) {
+	behavior := s.cfg.behavior
+	if cfg.behavior != nil {
+		behavior = cfg.behavior
+	}
+	if behavior != s.viewer.cfg {
+		s.viewer = newViewer(behavior, s.n)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// playbackBuffer models the client buffer of the main media track.
+// playback starts once startup seconds are buffered and stalls when the buffer runs dry.
+type playbackBuffer struct {
+	startup float64 // seconds to buffer before playback starts
+	level   float64 // buffered seconds at the time of at
+	at      time.Time
+	playing bool
+	held    bool   // paused by the viewer, nothing is played
+	restart string // seek or zap the buffer was flushed for, until playback restarts
+
+	begin      time.Time // session start (gslb request)
+	started    time.Time // first frame played
+	stallStart time.Time
+	stalls     int
+	stallTime  time.Duration
+}
+
+func newPlaybackBuffer(begin time.Time, startup float64) *playbackBuffer {
+	return &playbackBuffer{startup: startup, begin: begin, at: begin}
+}
+
+// advance plays the buffer until now, starting a stall if it runs dry.
+func (b *playbackBuffer) advance(now time.Time) {
+	if b.playing && !b.held {
+		played := now.Sub(b.at).Seconds()
+		if played >= b.level {
+			// ran dry at at + level
+			b.stallStart = b.at.Add(time.Duration(b.level * float64(time.Second)))
+			b.level = 0
+			b.playing = false
+			b.stalls++
+		} else {
+			b.level -= played
+		}
+	}
+	b.at = now
+}
+
+// add puts a downloaded segment of duration seconds into the buffer.
+func (b *playbackBuffer) add(duration float64, now time.Time) {
+	b.advance(now)
+	b.level += duration
+
+	if !b.playing && b.level >= b.startup {
+		b.playing = true
+		switch {
+		case b.started.IsZero():
+			b.started = now
+			stats.observe("startup", now.Sub(b.begin))
+		case b.restart != "":
+			stats.observe(b.restart, now.Sub(b.stallStart))
+			b.restart = ""
+		default:
+			b.stallTime += now.Sub(b.stallStart)
+			stats.observe("rebuffer", now.Sub(b.stallStart))
+		}
+	}
+}
+
+// hold pauses or resumes playback.
+func (b *playbackBuffer) hold(now time.Time, held bool) {
+	b.advance(now)
+	b.held = held
+}
+
+// flush empties the buffer for a seek or zap, the time until playback
+// restarts is recorded as phase instead of rebuffering.
+func (b *playbackBuffer) flush(now time.Time, phase string) {
+	b.finish(now)
+	b.level = 0
+	b.held = false
+	if !b.started.IsZero() {
+		b.playing = false
+		b.stallStart = now
+		b.restart = phase
+	}
+}
+
+// wait returns how long the client can idle until only target seconds are left.
+func (b *playbackBuffer) wait(target float64) time.Duration {
+	if !b.playing || b.level <= target {
+		return 0
+	}
+	return time.Duration((b.level - target) * float64(time.Second))
+}
+
+// finish closes a running stall at the end of the session.
+func (b *playbackBuffer) finish(now time.Time) {
+	b.advance(now)
+	if b.playing || b.started.IsZero() {
+		return
+	}
+
+	if b.restart != "" {
+		stats.observe(b.restart, now.Sub(b.stallStart))
+		b.restart = ""
+	} else {
+		b.stallTime += now.Sub(b.stallStart)
+		stats.observe("rebuffer", now.Sub(b.stallStart))
+	}
+}
+
+func (b *playbackBuffer) startupDelay() time.Duration {
+	if b.started.IsZero() {
+		return 0
+	}
+	return b.started.Sub(b.begin)
+}
+
+// endPlayback closes the buffer model of s and reports its QoE.
+func endPlayback(s *session) {
+	end := time.Now()
+	s.buffer.finish(end)
+	qoe.record(s.buffer, end)
+
+	log.Printf("[%d] qoe: startup %d ms, %d stalls, %d ms stalled", s.n, int(s.buffer.startupDelay())/1000000, s.buffer.stalls, int(s.buffer.stallTime)/1000000)
+}
+
+type qoeStats struct {
+	mu        sync.Mutex
+	sessions  int64
+	started   int64
+	startup   time.Duration
+	stalled   int64
+	stalls    int64
+	stallTime time.Duration
+	playTime  time.Duration
+}
+
+var qoe = &qoeStats{}
+
+func (q *qoeStats) record(b *playbackBuffer, end time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sessions++
+	if b.started.IsZero() {
+		return
+	}
+
+	q.started++
+	q.startup += b.startupDelay()
+	q.stalls += int64(b.stalls)
+	q.stallTime += b.stallTime
+	q.playTime += end.Sub(b.started)
+	if b.stalls > 0 {
+		q.stalled++
+	}
+}
+
+// qoeDump is the playback summary as agents send it to the coordinator
+type qoeDump struct {
+	Sessions  int64         `json:"sessions"`
+	Started   int64         `json:"started"`
+	Startup   time.Duration `json:"startup"`
+	Stalled   int64         `json:"stalled"`
+	Stalls    int64         `json:"stalls"`
+	StallTime time.Duration `json:"stallTime"`
+	PlayTime  time.Duration `json:"playTime"`
+}
+
+func (q *qoeStats) dump() qoeDump {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return qoeDump{q.sessions, q.started, q.startup, q.stalled, q.stalls, q.stallTime, q.playTime}
+}
+
+func (q *qoeStats) merge(d qoeDump) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sessions += d.Sessions
+	q.started += d.Started
+	q.startup += d.Startup
+	q.stalled += d.Stalled
+	q.stalls += d.Stalls
+	q.stallTime += d.StallTime
+	q.playTime += d.PlayTime
+}
+
+func (q *qoeStats) print() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	log.Println("playback qoe")
+	log.Printf("sessions %d, started %d, with stalls %d", q.sessions, q.started, q.stalled)
+	if q.started == 0 {
+		return
+	}
+
+	ratio := 0.0
+	if q.playTime > 0 {
+		ratio = float64(q.stallTime) / float64(q.playTime) * 100
+	}
+	log.Printf("average startup delay %d ms", int(q.startup/time.Duration(q.started))/1000000)
+	log.Printf("rebuffering %d events, %d ms total, %.2f%% of play time", q.stalls, int(q.stallTime)/1000000, ratio)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// byteRange is an EXT-X-BYTERANGE sub-range of a resource
+type byteRange struct {
+	limit  int64
+	offset int64
+}
+
+func (r *byteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.limit-1)
+}
+
+func segmentRange(segment *m3u8.MediaSegment) *byteRange {
+	if segment.Limit <= 0 {
+		return nil
+	}
+	return &byteRange{limit: segment.Limit, offset: segment.Offset}
+}
+
+func mapRange(m *m3u8.Map) *byteRange {
+	if m.Limit <= 0 {
+		return nil
+	}
+	return &byteRange{limit: m.Limit, offset: m.Offset}
+}
+
+// inheritMaps applies each EXT-X-MAP to the following segments up to the next EXT-X-MAP.
+func inheritMaps(mediapl *m3u8.MediaPlaylist) {
+	var m *m3u8.Map
+	for _, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		if segment.Map != nil {
+			m = segment.Map
+		}
+		segment.Map = m
+	}
+}
+
+// resolveRanges fills in the offset of a sub-range written without "@offset",
+// which starts right after the previous sub-range of the same resource.
+// the decoder reports such offsets as 0.
+func resolveRanges(mediapl *m3u8.MediaPlaylist) {
+	var prev *m3u8.MediaSegment
+	for _, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		if segment.Limit > 0 && segment.Offset == 0 && prev != nil && prev.Limit > 0 && prev.URI == segment.URI {
+			segment.Offset = prev.Offset + prev.Limit
+		}
+		prev = segment
+	}
+}
+
+// prepareSegments links the playlist level tags to every segment they apply to.
+func prepareSegments(mediapl *m3u8.MediaPlaylist) {
+	inheritKeys(mediapl)
+	inheritMaps(mediapl)
+	resolveRanges(mediapl)
+}
+
+// getInit fetches the EXT-X-MAP init section of a segment once per session.
+func getInit(m *m3u8.Map, base *url.URL, s *session) error {
+	initURL, err := absolutize(m.URI, base)
+	if err != nil {
+		return err
+	}
+
+	return getInitSection(initURL, mapRange(m), s)
+}
+
+// getInitSection fetches an init section once per session.
+func getInitSection(initURL *url.URL, r *byteRange, s *session) error {
+	id := initURL.String()
+	if r != nil {
+		id += "#" + r.header()
+	}
+	s.mu.Lock()
+	fetched := s.inits[id]
+	s.mu.Unlock()
+	if fetched {
+		return nil
+	}
+
+	start := time.Now()
+	err := s.retry("init", func() error {
+		start = time.Now()
+		return fetchInitSection(initURL, r, s)
+	})
+	if err != nil {
+		s.fail("init")
+		return err
+	}
+
+	stats.observe("init", time.Now().Sub(start))
+	log.Printf("[%d] init response time: %d ms", s.n, (int(time.Now().Sub(start)) / 1000000))
+
+	s.mu.Lock()
+	s.inits[id] = true
+	s.mu.Unlock()
+	return nil
+}
+
+func checkRangeSize(r *byteRange, size int64) error {
+	if r != nil && size != r.limit {
+		return fmt.Errorf("received %d bytes for range %s", size, r.header())
+	}
+	return nil
+}
+
+func fetchInitSection(initURL *url.URL, r *byteRange, s *session) error {
+	resp, err := getRangeResponse(initURL, s.client, r, "init")
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		err = checkRangeSize(r, size)
+	}
+	return err
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flags the coordinator sets per agent instead of forwarding them
+var coordinatorFlags = map[string]bool{
+	"agents": true, "agent-listen": true,
+	"filename": true, "count": true, "interval": true,
+	"profile": true, "profile-file": true, "behavior-file": true, "replay": true,
+	"results": true, "results-format": true, "report": true, "metrics-addr": true,
+	"session-offset": true, "session-step": true, "start-at": true, "stats-dump": true,
+	"agent-token": true,
+}
+
+// coordinator flags an agent accepts in a job, the coordinator sets them per agent
+var jobFlags = map[string]bool{
+	"count": true, "interval": true, "profile": true,
+	"session-offset": true, "session-step": true, "start-at": true,
+}
+
+// files a job may carry, each is passed as the flag of the same name
+var jobFiles = map[string]bool{"filename": true, "behavior-file": true, "replay": true}
+
+// agentTokenHeader carries the shared -agent-token of coordinator and agents
+const agentTokenHeader = "X-Agent-Token"
+
+// checkJob rejects files and flags a coordinator never sends, an agent must not
+// write outside its temporary directory or let a caller choose output paths.
+func checkJob(job agentJob) error {
+	for name := range job.Files {
+		if !jobFiles[name] {
+			return fmt.Errorf("file not allowed : %s", name)
+		}
+	}
+	for _, arg := range job.Args {
+		name := strings.TrimLeft(arg, "-")
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name = name[:idx]
+		}
+		if !strings.HasPrefix(arg, "-") || flag.Lookup(name) == nil {
+			return fmt.Errorf("invalid argument : %s", arg)
+		}
+		if coordinatorFlags[name] && !jobFlags[name] {
+			return fmt.Errorf("flag not allowed : %s", name)
+		}
+	}
+	return nil
+}
+
+// agentJob is the part of a run the coordinator hands to one agent.
+// Files are written to temporary files by the agent and passed as the flag of the same name.
+type agentJob struct {
+	Args  []string          `json:"args"`
+	Files map[string]string `json:"files"`
+}
+
+// agentMessage is one line of the agent response stream
+type agentMessage struct {
+	Result *sessionResult           `json:"result,omitempty"`
+	Stats  map[string]histogramDump `json:"stats,omitempty"`
+	QoE    *qoeDump                 `json:"qoe,omitempty"`
+	Timing []requestTiming          `json:"timing,omitempty"`
+	Titles []titleCount             `json:"titles,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+// statsDump is what a generator run for an agent leaves for the coordinator
+type statsDump struct {
+	Stats    map[string]histogramDump `json:"stats"`
+	QoE      qoeDump                  `json:"qoe"`
+	Requests []requestTiming          `json:"requests"`
+	Titles   []titleCount             `json:"titles"`
+}
+
+func writeStatsDump(fileName string) error {
+	doc, err := json.Marshal(statsDump{Stats: stats.dump(), QoE: qoe.dump(), Requests: requestTimings.dump(), Titles: titles.dump()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, doc, 0644)
+}
+
+// agent runs one job at a time as a child generator process
+type agent struct {
+	token string // required of every request when set
+	mu    sync.Mutex
+	child *exec.Cmd
+}
+
+// authorized checks the token of r and answers 403 when it does not match.
+func (a *agent) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(agentTokenHeader)), []byte(a.token)) != 1 {
+		log.Printf("agent: request from %s with a wrong token", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (a *agent) run(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	var job agentJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkJob(job); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "hlsagent")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	args := append([]string{}, job.Args...)
+	for name, content := range job.Files {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args = append(args, "-"+name+"="+fileName)
+	}
+	dumpFile := filepath.Join(dir, "stats.json")
+	args = append(args, "-results=-", "-results-format="+resultJSONL, "-stats-dump="+dumpFile)
+
+	exe, err := os.Executable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a.mu.Lock()
+	if a.child != nil {
+		a.mu.Unlock()
+		http.Error(w, "agent is busy", http.StatusConflict)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		a.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.child = cmd
+	a.mu.Unlock()
+
+	log.Printf("agent: job from %s started", r.RemoteAddr)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(m agentMessage) {
+		enc.Encode(m)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var result sessionResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+		send(agentMessage{Result: &result})
+	}
+
+	err = cmd.Wait()
+	a.mu.Lock()
+	a.child = nil
+	a.mu.Unlock()
+
+	if err != nil {
+		send(agentMessage{Error: err.Error()})
+	}
+
+	doc, err := ioutil.ReadFile(dumpFile)
+	if err == nil {
+		var dump statsDump
+		if err = json.Unmarshal(doc, &dump); err == nil {
+			send(agentMessage{Stats: dump.Stats, QoE: &dump.QoE, Timing: dump.Requests, Titles: dump.Titles})
+		}
+	}
+	if err != nil {
+		send(agentMessage{Error: fmt.Sprintf("stats: %s", err)})
+	}
+	log.Printf("agent: job from %s ended", r.RemoteAddr)
+}
+
+// stop interrupts the running job, it stops gracefully like on SIGINT.
+func (a *agent) stop(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.child != nil && a.child.Process != nil {
+		a.child.Process.Signal(os.Interrupt)
+		log.Printf("agent: job stopped by %s", r.RemoteAddr)
+	}
+}
+
+// serveAgent waits for jobs of a coordinator on addr. the jobs run the generator with
+// arguments of the caller, so without token addr must only be reachable from trusted hosts.
+func serveAgent(addr string, token string) error {
+	if token == "" {
+		log.Printf("agent: no -agent-token, any host reaching %s can run jobs", addr)
+	}
+	a := &agent{token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", a.run)
+	mux.HandleFunc("/stop", a.stop)
+
+	log.Printf("agent listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// forwardedArgs returns the flags given on the command line that every agent gets as is.
+func forwardedArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !coordinatorFlags[f.Name] {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// splitCount returns how many of count sessions numbered i, i+agents, ... agent i runs.
+func splitCount(count, agents, i int) int {
+	if i >= count {
+		return 0
+	}
+	return (count - i + agents - 1) / agents
+}
+
+// splitProfile returns the share of agent i of a load profile.
+func splitProfile(stages []loadStage, agents, i int) string {
+	var parts []string
+	for _, stage := range stages {
+		if stage.kind == stageRamp {
+			stage.target = splitCount(stage.target, agents, i)
+		}
+		parts = append(parts, stage.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitTrace returns the trace lines of the sessions agent i replays.
+func splitTrace(traces []*traceSession, agents, i int) string {
+	var buf bytes.Buffer
+	for idx := i; idx < len(traces); idx += agents {
+		ts := traces[idx]
+		for _, tr := range ts.requests {
+			fmt.Fprintf(&buf, "%.6f %s %s %s\n", float64(tr.at.UnixNano())/float64(time.Second), ts.id, ts.clientIP, tr.uri)
+		}
+	}
+	return buf.String()
+}
+
+// coordinatorRun describes the whole run split across the agents
+type coordinatorRun struct {
+	agents   []string
+	config   string // generation info file content
+	count    int
+	interval int // milliseconds between session starts of the whole run
+	stages   []loadStage
+	traces   []*traceSession
+	scale    float64 // replay time scale
+	behavior string  // behavior file content
+	token    string
+}
+
+func (c *coordinatorRun) job(i int, startAt time.Time) (agentJob, bool) {
+	n := len(c.agents)
+	job := agentJob{
+		Args:  forwardedArgs(),
+		Files: map[string]string{"filename": c.config},
+	}
+	if c.behavior != "" {
+		job.Files["behavior-file"] = c.behavior
+	}
+
+	switch {
+	case c.traces != nil:
+		if i >= len(c.traces) {
+			return job, false
+		}
+		job.Files["replay"] = splitTrace(c.traces, n, i)
+		delete(job.Files, "filename")
+		// an agent replays from its first session, keep its offset to the whole trace
+		offset := c.traces[i].requests[0].at.Sub(c.traces[0].requests[0].at)
+		startAt = startAt.Add(time.Duration(float64(offset) * c.scale))
+	case c.stages != nil:
+		job.Args = append(job.Args, "-profile="+splitProfile(c.stages, n, i))
+	default:
+		count := splitCount(c.count, n, i)
+		if count == 0 {
+			return job, false
+		}
+		job.Args = append(job.Args, fmt.Sprintf("-count=%d", count), fmt.Sprintf("-interval=%d", c.interval*n))
+		// the sessions of the agents interleave like in a single process
+		startAt = startAt.Add(time.Duration(i*c.interval) * time.Millisecond)
+	}
+
+	job.Args = append(job.Args,
+		fmt.Sprintf("-session-offset=%d", i),
+		fmt.Sprintf("-session-step=%d", n),
+		fmt.Sprintf("-start-at=%d", startAt.UnixNano()/int64(time.Millisecond)))
+	return job, true
+}
+
+// agentRequest posts body to path of the agent at addr with the shared token.
+func agentRequest(ctx context.Context, addr, path, token string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(agentTokenHeader, token)
+	}
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// runAgent sends job to the agent at addr and merges what it streams back.
+func runAgent(ctx context.Context, addr, token string, job agentJob) error {
+	doc, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	resp, err := agentRequest(ctx, addr, "/run", token, doc)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Received HTTP %v from agent %s: %s", resp.StatusCode, addr, strings.TrimSpace(string(body)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var m agentMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return err
+		}
+
+		switch {
+		case m.Result != nil:
+			recovery.record(m.Result)
+			results.add(m.Result)
+		case m.Stats != nil:
+			stats.merge(m.Stats)
+			if m.QoE != nil {
+				qoe.merge(*m.QoE)
+			}
+			requestTimings.merge(m.Timing)
+			titles.merge(m.Titles)
+		case m.Error != "":
+			log.Printf("agent %s error: %s", addr, m.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+// runCoordinator starts the agents in sync and waits until all of them streamed their results.
+func runCoordinator(c *coordinatorRun) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// leave the agents time to receive the job before the common start
+	startAt := time.Now().Add(2 * time.Second)
+
+	wg := new(sync.WaitGroup)
+	for i, addr := range c.agents {
+		job, ok := c.job(i, startAt)
+		if !ok {
+			log.Printf("agent %s: nothing to run", addr)
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr string, job agentJob) {
+			defer wg.Done()
+			if err := runAgent(ctx, addr, c.token, job); err != nil {
+				log.Printf("agent %s error: %s", addr, err)
+			}
+		}(addr, job)
+	}
+
+	go func() {
+		<-control.stopping
+		for _, addr := range c.agents {
+			resp, err := agentRequest(context.Background(), addr, "/stop", c.token, nil)
+			if err != nil {
+				log.Printf("agent %s error: %s", addr, err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	control.wait(wg)
+}
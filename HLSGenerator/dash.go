@@ -0,0 +1,785 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streaming protocols
+const (
+	protocolHLS  = "hls"
+	protocolDASH = "dash"
+)
+
+// dashLiveWindow is the number of segments a live presentation lists up to its edge
+const dashLiveWindow = 10
+
+type mpdDocument struct {
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	MinimumUpdatePeriod       string      `xml:"minimumUpdatePeriod,attr"`
+	AvailabilityStartTime     string      `xml:"availabilityStartTime,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Start          string             `xml:"start,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType     string              `xml:"contentType,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	Lang            string              `xml:"lang,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       uint32              `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string              `xml:"media,attr"`
+	Initialization         string              `xml:"initialization,attr"`
+	Timescale              uint64              `xml:"timescale,attr"`
+	Duration               uint64              `xml:"duration,attr"`
+	StartNumber            *uint64             `xml:"startNumber,attr"`
+	PresentationTimeOffset uint64              `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []mpdTimelineEntry `xml:"S"`
+}
+
+type mpdTimelineEntry struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int64   `xml:"r,attr"`
+}
+
+type mpdSegmentBase struct {
+	Timescale      uint64             `xml:"timescale,attr"`
+	IndexRange     string             `xml:"indexRange,attr"`
+	Initialization *mpdInitialization `xml:"Initialization"`
+}
+
+type mpdInitialization struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// dashSegment is a media segment of a representation
+type dashSegment struct {
+	url      *url.URL
+	rng      *byteRange
+	start    float64 // seconds from the period start
+	duration float64
+}
+
+// dashTrack is a representation with its inherited segment addressing
+type dashTrack struct {
+	rep      *mpdRepresentation
+	base     *url.URL
+	template *mpdSegmentTemplate
+	segBase  *mpdSegmentBase
+
+	index []dashSegment // SegmentBase: segments from the sidx, fetched once
+}
+
+var iso8601Duration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses xs:duration values such as "PT1H2M3.5S".
+func parseISODuration(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	m := iso8601Duration.FindStringSubmatch(v)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %s", v)
+	}
+
+	var sec float64
+	for idx, unit := range []float64{86400, 3600, 60, 1} {
+		if m[idx+1] == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(m[idx+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		sec += f * unit
+	}
+	return sec, nil
+}
+
+func decodeMPD(content io.Reader) (*mpdDocument, error) {
+	doc := &mpdDocument{}
+	if err := xml.NewDecoder(content).Decode(doc); err != nil {
+		return nil, err
+	}
+
+	if len(doc.Periods) == 0 {
+		return nil, fmt.Errorf("no period in mpd")
+	}
+	return doc, nil
+}
+
+func getMPD(u *url.URL, s *session) (*mpdDocument, error) {
+	var doc *mpdDocument
+	start := time.Now()
+	err := s.retry("playlist", func() error {
+		start = time.Now()
+		var err error
+		doc, err = fetchMPD(u, s)
+		return err
+	})
+	if err != nil {
+		s.fail("playlist")
+		return nil, err
+	}
+
+	stats.observe("playlist", time.Now().Sub(start))
+	return doc, nil
+}
+
+func fetchMPD(u *url.URL, s *session) (*mpdDocument, error) {
+	content, _, err := getContent(u, s.client, "playlist")
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := decodeMPD(content)
+	content.Close()
+	return doc, err
+}
+
+func resolveBase(base *url.URL, ref string) (*url.URL, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return base, nil
+	}
+	return base.Parse(ref)
+}
+
+func (a *mpdAdaptationSet) kind() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+
+	mimeType := a.MimeType
+	if mimeType == "" && len(a.Representations) > 0 {
+		mimeType = a.Representations[0].MimeType
+	}
+	return strings.Split(mimeType, "/")[0]
+}
+
+// tracks returns the representations of a in ascending bandwidth.
+func (a *mpdAdaptationSet) tracks(doc *mpdDocument, period *mpdPeriod, mpdURL *url.URL) ([]*dashTrack, error) {
+	base := mpdURL
+	for _, ref := range []string{doc.BaseURL, period.BaseURL, a.BaseURL} {
+		var err error
+		if base, err = resolveBase(base, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	var tracks []*dashTrack
+	for idx := range a.Representations {
+		rep := &a.Representations[idx]
+		repBase, err := resolveBase(base, rep.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		track := &dashTrack{rep: rep, base: repBase, template: a.SegmentTemplate, segBase: a.SegmentBase}
+		if rep.SegmentTemplate != nil {
+			track.template = rep.SegmentTemplate
+		}
+		if rep.SegmentBase != nil {
+			track.segBase = rep.SegmentBase
+		}
+		if track.template == nil && track.segBase == nil && rep.BaseURL == "" {
+			return nil, fmt.Errorf("representation %s has no segment addressing", rep.ID)
+		}
+		tracks = append(tracks, track)
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].rep.Bandwidth < tracks[j].rep.Bandwidth
+	})
+	return tracks, nil
+}
+
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(%0\d+d)?\$`)
+
+func (t *dashTrack) expand(tmpl string, number, tm uint64) string {
+	tmpl = templateIdentifier.ReplaceAllStringFunc(tmpl, func(id string) string {
+		m := templateIdentifier.FindStringSubmatch(id)
+		format := "%d"
+		if m[2] != "" {
+			format = m[2]
+		}
+		switch m[1] {
+		case "RepresentationID":
+			return t.rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, tm)
+		default:
+			return fmt.Sprintf(format, t.rep.Bandwidth)
+		}
+	})
+	return strings.Replace(tmpl, "$$", "$", -1)
+}
+
+func parseRange(v string) (*byteRange, error) {
+	var first, last int64
+	if _, err := fmt.Sscanf(v, "%d-%d", &first, &last); err != nil || last < first {
+		return nil, fmt.Errorf("invalid range %s", v)
+	}
+	return &byteRange{limit: last - first + 1, offset: first}, nil
+}
+
+// initSection returns the init segment of the track, nil if there is none.
+func (t *dashTrack) initSection() (*url.URL, *byteRange, error) {
+	if t.template != nil {
+		if t.template.Initialization == "" {
+			return nil, nil, nil
+		}
+		u, err := resolveBase(t.base, t.expand(t.template.Initialization, 0, 0))
+		return u, nil, err
+	}
+
+	if t.segBase != nil && t.segBase.Initialization != nil {
+		u, err := resolveBase(t.base, t.segBase.Initialization.SourceURL)
+		if err != nil || t.segBase.Initialization.Range == "" {
+			return u, nil, err
+		}
+		r, err := parseRange(t.segBase.Initialization.Range)
+		return u, r, err
+	}
+	return nil, nil, nil
+}
+
+// segments lists the segments of the track within periodDuration seconds.
+// for a live presentation only segments available at now are listed.
+func (t *dashTrack) segments(s *session, doc *mpdDocument, periodStart, periodDuration float64, now time.Time) ([]dashSegment, error) {
+	switch {
+	case t.template != nil && t.template.SegmentTimeline != nil:
+		return t.timelineSegments(doc, periodStart, periodDuration, now)
+	case t.template != nil:
+		return t.numberSegments(doc, periodStart, periodDuration, now)
+	case t.segBase != nil:
+		return t.indexSegments(s)
+	}
+
+	// a single segment at BaseURL
+	return []dashSegment{{url: t.base, duration: periodDuration}}, nil
+}
+
+func (t *dashTrack) timescale() float64 {
+	if t.template != nil && t.template.Timescale > 0 {
+		return float64(t.template.Timescale)
+	}
+	if t.segBase != nil && t.segBase.Timescale > 0 {
+		return float64(t.segBase.Timescale)
+	}
+	return 1
+}
+
+func (t *dashTrack) startNumber() uint64 {
+	if t.template.StartNumber != nil {
+		return *t.template.StartNumber
+	}
+	return 1
+}
+
+func (t *dashTrack) segment(number, tm, d uint64) (dashSegment, error) {
+	u, err := resolveBase(t.base, t.expand(t.template.Media, number, tm))
+	if err != nil {
+		return dashSegment{}, err
+	}
+
+	scale := t.timescale()
+	return dashSegment{
+		url:      u,
+		start:    (float64(tm) - float64(t.template.PresentationTimeOffset)) / scale,
+		duration: float64(d) / scale,
+	}, nil
+}
+
+// liveEdge returns the seconds of the period whose segments are available at now.
+func liveEdge(doc *mpdDocument, periodStart float64, now time.Time) (float64, error) {
+	ast, err := time.Parse(time.RFC3339, doc.AvailabilityStartTime)
+	if err != nil {
+		return 0, fmt.Errorf("invalid availabilityStartTime %s", doc.AvailabilityStartTime)
+	}
+	return now.Sub(ast).Seconds() - periodStart, nil
+}
+
+func (t *dashTrack) timelineSegments(doc *mpdDocument, periodStart, periodDuration float64, now time.Time) ([]dashSegment, error) {
+	// a negative repeat runs to the end of the period, live to the segments available at now
+	limit := periodDuration
+	live := doc.Type == "dynamic"
+	if live {
+		edge, err := liveEdge(doc, periodStart, now)
+		if err != nil {
+			return nil, err
+		}
+		if limit <= 0 || edge < limit {
+			limit = edge
+		}
+	}
+
+	var segments []dashSegment
+	entries := t.template.SegmentTimeline.S
+	number := t.startNumber()
+	scale := t.timescale()
+	var tm uint64
+
+	for idx, e := range entries {
+		if e.T != nil {
+			tm = *e.T
+		}
+		if e.D == 0 {
+			return nil, fmt.Errorf("segment timeline entry without duration")
+		}
+
+		repeat := e.R
+		if repeat < 0 {
+			// repeat until the next entry or the end of the period
+			end := t.template.PresentationTimeOffset
+			if limit > 0 {
+				end += uint64(limit * scale)
+			}
+			if idx+1 < len(entries) && entries[idx+1].T != nil {
+				end = *entries[idx+1].T
+			}
+
+			repeat = 0
+			switch {
+			case live:
+				// only segments whose end is past are available
+				repeat = -1
+				if end > tm {
+					repeat = int64((end-tm)/e.D) - 1
+				}
+				if repeat >= dashLiveWindow {
+					skip := uint64(repeat + 1 - dashLiveWindow)
+					number += skip
+					tm += skip * e.D
+					repeat = dashLiveWindow - 1
+				}
+			case end > tm:
+				repeat = int64((end-tm+e.D-1)/e.D) - 1
+			}
+		}
+
+		for r := int64(0); r <= repeat; r++ {
+			seg, err := t.segment(number, tm, e.D)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+			number++
+			tm += e.D
+		}
+	}
+	return segments, nil
+}
+
+func (t *dashTrack) numberSegments(doc *mpdDocument, periodStart, periodDuration float64, now time.Time) ([]dashSegment, error) {
+	if t.template.Duration == 0 {
+		return nil, fmt.Errorf("segment template without duration or timeline")
+	}
+
+	d := t.template.Duration
+	segDuration := float64(d) / t.timescale()
+	first := uint64(0)
+	count := uint64(math.Ceil(periodDuration / segDuration))
+
+	if doc.Type == "dynamic" {
+		// segments whose end is already past are available
+		elapsed, err := liveEdge(doc, periodStart, now)
+		if err != nil {
+			return nil, err
+		}
+		if elapsed < segDuration {
+			return nil, nil
+		}
+		available := uint64(elapsed / segDuration)
+		if available > dashLiveWindow {
+			first = available - dashLiveWindow
+		}
+		count = available
+	}
+
+	var segments []dashSegment
+	for idx := first; idx < count; idx++ {
+		seg, err := t.segment(t.startNumber()+idx, idx*d+t.template.PresentationTimeOffset, d)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// indexSegments reads the sidx box at indexRange and lists its subsegments.
+func (t *dashTrack) indexSegments(s *session) ([]dashSegment, error) {
+	if t.index != nil {
+		return t.index, nil
+	}
+
+	r, err := parseRange(t.segBase.IndexRange)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	start := time.Now()
+	err = s.retry("init", func() error {
+		start = time.Now()
+		resp, err := getRangeResponse(t.base, s.client, r, "init")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		s.fail("init")
+		return nil, err
+	}
+	elapsed := time.Now().Sub(start)
+
+	t.index, err = parseSidx(data, t.base, r.offset+r.limit)
+	if err != nil {
+		stats.fail("init")
+		s.fail("init")
+		return nil, err
+	}
+	stats.observe("init", elapsed)
+	return t.index, nil
+}
+
+// parseSidx lists the subsegments of a sidx box; offsets count from anchor,
+// the first byte after the sidx box.
+func parseSidx(data []byte, u *url.URL, anchor int64) ([]dashSegment, error) {
+	if len(data) < 12 || string(data[4:8]) != "sidx" {
+		return nil, fmt.Errorf("no sidx box in index range")
+	}
+
+	version := data[8]
+	pos := 12 + 4 // version/flags, reference_ID
+	if len(data) < pos+4 {
+		return nil, fmt.Errorf("short sidx box")
+	}
+	timescale := float64(binary.BigEndian.Uint32(data[pos:]))
+	pos += 4
+
+	var earliest, offset uint64
+	if version == 0 {
+		if len(data) < pos+8 {
+			return nil, fmt.Errorf("short sidx box")
+		}
+		earliest = uint64(binary.BigEndian.Uint32(data[pos:]))
+		offset = uint64(binary.BigEndian.Uint32(data[pos+4:]))
+		pos += 8
+	} else {
+		if len(data) < pos+16 {
+			return nil, fmt.Errorf("short sidx box")
+		}
+		earliest = binary.BigEndian.Uint64(data[pos:])
+		offset = binary.BigEndian.Uint64(data[pos+8:])
+		pos += 16
+	}
+
+	if len(data) < pos+4 || timescale == 0 {
+		return nil, fmt.Errorf("short sidx box")
+	}
+	count := int(binary.BigEndian.Uint16(data[pos+2:]))
+	pos += 4
+
+	if len(data) < pos+count*12 {
+		return nil, fmt.Errorf("short sidx box")
+	}
+
+	var segments []dashSegment
+	start := anchor + int64(offset)
+	tm := float64(earliest) / timescale
+	for i := 0; i < count; i++ {
+		ref := binary.BigEndian.Uint32(data[pos:])
+		size := int64(ref & 0x7fffffff)
+		duration := float64(binary.BigEndian.Uint32(data[pos+4:])) / timescale
+		pos += 12
+
+		if ref&0x80000000 != 0 {
+			return nil, fmt.Errorf("hierarchical sidx is not supported")
+		}
+
+		segments = append(segments, dashSegment{
+			url:      u,
+			rng:      &byteRange{limit: size, offset: start},
+			start:    tm,
+			duration: duration,
+		})
+		start += size
+		tm += duration
+	}
+	return segments, nil
+}
+
+// dashPresentation is the period of an MPD a session plays
+type dashPresentation struct {
+	doc      *mpdDocument
+	url      *url.URL
+	start    float64
+	duration float64
+	video    []*dashTrack
+	audio    *dashTrack
+}
+
+func newDashPresentation(doc *mpdDocument, mpdURL *url.URL) (*dashPresentation, error) {
+	// a live presentation plays its newest period
+	idx := 0
+	if doc.Type == "dynamic" {
+		idx = len(doc.Periods) - 1
+	}
+	period := &doc.Periods[idx]
+
+	d := &dashPresentation{doc: doc, url: mpdURL}
+
+	var err error
+	if d.start, err = parseISODuration(period.Start); err != nil {
+		return nil, err
+	}
+	if d.duration, err = parseISODuration(period.Duration); err != nil {
+		return nil, err
+	}
+	if d.duration == 0 {
+		total, err := parseISODuration(doc.MediaPresentationDuration)
+		if err != nil {
+			return nil, err
+		}
+		// a live MPD may have no presentation duration, only a period start
+		d.duration = math.Max(total-d.start, 0)
+	}
+
+	for idx := range period.AdaptationSets {
+		set := &period.AdaptationSets[idx]
+		switch set.kind() {
+		case "video":
+			if d.video == nil {
+				if d.video, err = set.tracks(doc, period, mpdURL); err != nil {
+					return nil, err
+				}
+			}
+		case "audio":
+			if d.audio == nil {
+				tracks, err := set.tracks(doc, period, mpdURL)
+				if err != nil {
+					return nil, err
+				}
+				if len(tracks) > 0 {
+					// the lowest bitrate audio, like most players start with
+					d.audio = tracks[0]
+				}
+			}
+		}
+	}
+
+	if len(d.video) == 0 {
+		return nil, fmt.Errorf("no video representation in mpd")
+	}
+	return d, nil
+}
+
+// reload refreshes a live MPD and keeps the tracks in the same order.
+func (d *dashPresentation) reload(s *session) error {
+	doc, err := getMPD(d.url, s)
+	if err != nil {
+		return err
+	}
+
+	fresh, err := newDashPresentation(doc, d.url)
+	if err != nil {
+		return err
+	}
+	if len(fresh.video) != len(d.video) {
+		return fmt.Errorf("representations changed on mpd update")
+	}
+	*d = *fresh
+	return nil
+}
+
+func (d *dashPresentation) updatePeriod() time.Duration {
+	sec, err := parseISODuration(d.doc.MinimumUpdatePeriod)
+	if err != nil || sec <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// fetchTrack downloads the init section of the track and the segment seg under phase.
+func fetchTrack(track *dashTrack, seg dashSegment, s *session, f float64, phase string) (int64, time.Duration, error) {
+	initURL, initRange, err := track.initSection()
+	if err != nil {
+		return 0, 0, err
+	}
+	if initURL != nil {
+		if err := getInitSection(initURL, initRange, s); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return downloadPhase(phase, seg.url, seg.rng, s, f, nil, false)
+}
+
+// playDash plays an MPD for t seconds with the same pacing and metrics as HLS.
+func playDash(s *session, content io.Reader, mpdURL *url.URL, t int) error {
+	doc, err := decodeMPD(content)
+	if err != nil {
+		s.fail("vod")
+		return err
+	}
+
+	d, err := newDashPresentation(doc, mpdURL)
+	if err != nil {
+		s.fail("vod")
+		return err
+	}
+
+	var ladder []uint32
+	for _, track := range d.video {
+		ladder = append(ladder, track.rep.Bandwidth)
+	}
+	p := newLadderPlayer(ladder, 0, s.cfg.abr, s.n)
+	p.playback = s.buffer
+
+	live := doc.Type == "dynamic"
+	if live {
+		s.kind = "dash live"
+		log.Printf("[%d] DASH Live Session", s.n)
+	} else {
+		s.kind = "dash vod"
+		log.Printf("[%d] DASH VOD Session", s.n)
+	}
+
+	end := time.Now().Add(time.Duration(t) * time.Second)
+	played := -1.0   // start of the last played video segment
+	audioEnd := 0.0  // end of the last played audio segment
+	started := false // live: positioned behind the live edge
+
+	// segment lists per track, listed again once the live edge may have moved
+	lists := make(map[*dashTrack][]dashSegment)
+	list := func(track *dashTrack) ([]dashSegment, error) {
+		if segments, ok := lists[track]; ok {
+			return segments, nil
+		}
+		segments, err := track.segments(s, d.doc, d.start, d.duration, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		lists[track] = segments
+		return segments, nil
+	}
+
+	for time.Now().Before(end) && !s.stopped() {
+		track := d.video[p.current]
+		segments, err := list(track)
+		if err != nil {
+			return err
+		}
+
+		if live && !started && len(segments) > 0 {
+			started = true
+			if from := len(segments) - s.cfg.liveDelay; from > 0 {
+				// with no delay from is past the last segment, start at the next one
+				played = segments[from-1].start
+				audioEnd = played + segments[from-1].duration
+			}
+		}
+
+		// segments are in presentation order, the next one follows played
+		next := sort.Search(len(segments), func(i int) bool {
+			seg := segments[i]
+			return seg.start > played+seg.duration/2 || (played < 0 && seg.start >= 0)
+		})
+
+		if next == len(segments) {
+			if !live {
+				break
+			}
+			// wait for the live edge to advance
+			s.sleep(d.updatePeriod())
+			if d.doc.MinimumUpdatePeriod != "" {
+				if err := d.reload(s); err != nil {
+					return err
+				}
+			}
+			lists = make(map[*dashTrack][]dashSegment)
+			continue
+		}
+
+		seg := segments[next]
+
+		if d.audio != nil {
+			audioSegments, err := list(d.audio)
+			if err != nil {
+				return err
+			}
+			from := sort.Search(len(audioSegments), func(i int) bool {
+				return audioSegments[i].start+audioSegments[i].duration > audioEnd
+			})
+			for _, aseg := range audioSegments[from:] {
+				if aseg.start >= seg.start+seg.duration {
+					break
+				}
+				if _, _, err := fetchTrack(d.audio, aseg, s, 0, "audio"); err != nil {
+					return err
+				}
+				audioEnd = aseg.start + aseg.duration
+			}
+		}
+
+		size, elapsed, err := fetchTrack(track, seg, s, seg.duration, "segment")
+		if err != nil {
+			return err
+		}
+		played = seg.start
+
+		p.update(size, elapsed, seg.duration)
+		p.next()
+	}
+
+	log.Printf("[%d] abr %s: %d segments, %d switches", s.n, s.cfg.abr.strategy, p.segments, p.switches)
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		err  bool
+	}{
+		{"", 0, false},
+		{"PT6S", 6, false},
+		{"PT0.5S", 0.5, false},
+		{"PT1H2M3.5S", 3723.5, false},
+		{"PT90M", 5400, false},
+		{"P1DT1S", 86401, false},
+		{"P2D", 172800, false},
+		{"P1H", 0, true}, // hours need the T
+		{"PT1.5", 0, true},
+		{"6S", 0, true},
+		{"PT-1S", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseISODuration(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseISODuration(%q) error %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseISODuration(%q) = %g, want %g", tt.in, got, tt.want)
+		}
+	}
+}
+
+func templateTrack(tmpl *mpdSegmentTemplate) *dashTrack {
+	base, _ := url.Parse("http://edge/dash/")
+	return &dashTrack{rep: &mpdRepresentation{ID: "v1", Bandwidth: 500000}, base: base, template: tmpl}
+}
+
+func uint64p(v uint64) *uint64 {
+	return &v
+}
+
+func TestExpand(t *testing.T) {
+	track := templateTrack(&mpdSegmentTemplate{})
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"$RepresentationID$/$Number$.m4s", "v1/7.m4s"},
+		{"seg$Number%05d$.m4s", "seg00007.m4s"},
+		{"$Time$.m4s", "96000.m4s"},
+		{"t$Time%012d$.m4s", "t000000096000.m4s"},
+		{"$Bandwidth$/init.mp4", "500000/init.mp4"},
+		{"cost$$$Number$.m4s", "cost$7.m4s"},
+		{"$Unknown$.m4s", "$Unknown$.m4s"},
+	}
+	for _, tt := range tests {
+		if got := track.expand(tt.tmpl, 7, 96000); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+// segmentSpec is what the tests check of a dashSegment
+type segmentSpec struct {
+	path     string
+	start    float64
+	duration float64
+}
+
+func checkSegments(t *testing.T, name string, got []dashSegment, want []segmentSpec) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: %d segments, want %d", name, len(got), len(want))
+		return
+	}
+	for idx, seg := range got {
+		w := want[idx]
+		if seg.url.Path != w.path || seg.start != w.start || seg.duration != w.duration {
+			t.Errorf("%s: segment %d = %s %g+%g, want %s %g+%g", name, idx, seg.url.Path, seg.start, seg.duration, w.path, w.start, w.duration)
+		}
+	}
+}
+
+func TestTimelineSegments(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)
+	live := mpdDocument{Type: "dynamic", AvailabilityStartTime: now.Add(-25 * time.Second).Format(time.RFC3339)}
+
+	tests := []struct {
+		name   string
+		doc    mpdDocument
+		tmpl   mpdSegmentTemplate
+		s      []mpdTimelineEntry
+		start  float64
+		period float64
+		want   []segmentSpec
+		err    bool
+	}{
+		{
+			name:   "repeat",
+			tmpl:   mpdSegmentTemplate{Timescale: 1000},
+			s:      []mpdTimelineEntry{{T: uint64p(0), D: 2000, R: 2}},
+			period: 100,
+			want:   []segmentSpec{{"/dash/1.m4s", 0, 2}, {"/dash/2.m4s", 2, 2}, {"/dash/3.m4s", 4, 2}},
+		},
+		{
+			name:   "negative repeat to the period end",
+			tmpl:   mpdSegmentTemplate{Timescale: 1000},
+			s:      []mpdTimelineEntry{{T: uint64p(0), D: 2000, R: -1}},
+			period: 6,
+			want:   []segmentSpec{{"/dash/1.m4s", 0, 2}, {"/dash/2.m4s", 2, 2}, {"/dash/3.m4s", 4, 2}},
+		},
+		{
+			name:   "negative repeat covers a partial last segment",
+			tmpl:   mpdSegmentTemplate{Timescale: 1000},
+			s:      []mpdTimelineEntry{{T: uint64p(0), D: 2000, R: -1}},
+			period: 5,
+			want:   []segmentSpec{{"/dash/1.m4s", 0, 2}, {"/dash/2.m4s", 2, 2}, {"/dash/3.m4s", 4, 2}},
+		},
+		{
+			name: "negative repeat to the next entry",
+			tmpl: mpdSegmentTemplate{Timescale: 1000},
+			s: []mpdTimelineEntry{
+				{T: uint64p(0), D: 1000, R: -1},
+				{T: uint64p(3000), D: 500, R: 1},
+			},
+			period: 100,
+			want: []segmentSpec{
+				{"/dash/1.m4s", 0, 1}, {"/dash/2.m4s", 1, 1}, {"/dash/3.m4s", 2, 1},
+				{"/dash/4.m4s", 3, 0.5}, {"/dash/5.m4s", 3.5, 0.5},
+			},
+		},
+		{
+			name:   "negative repeat past the period end",
+			tmpl:   mpdSegmentTemplate{Timescale: 1},
+			s:      []mpdTimelineEntry{{T: uint64p(10), D: 2, R: -1}},
+			period: 6,
+			want:   []segmentSpec{{"/dash/1.m4s", 10, 2}},
+		},
+		{
+			name: "start number, time gap and presentation time offset",
+			tmpl: mpdSegmentTemplate{Timescale: 10, StartNumber: uint64p(100), PresentationTimeOffset: 50},
+			s: []mpdTimelineEntry{
+				{T: uint64p(50), D: 20},
+				{T: uint64p(100), D: 10, R: 1},
+			},
+			period: 100,
+			want:   []segmentSpec{{"/dash/100.m4s", 0, 2}, {"/dash/101.m4s", 5, 1}, {"/dash/102.m4s", 6, 1}},
+		},
+		{
+			// 12 segments are complete 25 s after the start, the last 10 are listed
+			name: "dynamic negative repeat to now",
+			doc:  live,
+			tmpl: mpdSegmentTemplate{Timescale: 1},
+			s:    []mpdTimelineEntry{{T: uint64p(0), D: 2, R: -1}},
+			want: []segmentSpec{
+				{"/dash/3.m4s", 4, 2}, {"/dash/4.m4s", 6, 2}, {"/dash/5.m4s", 8, 2}, {"/dash/6.m4s", 10, 2},
+				{"/dash/7.m4s", 12, 2}, {"/dash/8.m4s", 14, 2}, {"/dash/9.m4s", 16, 2}, {"/dash/10.m4s", 18, 2},
+				{"/dash/11.m4s", 20, 2}, {"/dash/12.m4s", 22, 2},
+			},
+		},
+		{
+			name:  "dynamic negative repeat after the period start",
+			doc:   live,
+			tmpl:  mpdSegmentTemplate{Timescale: 1000},
+			s:     []mpdTimelineEntry{{T: uint64p(0), D: 2000, R: -1}},
+			start: 20,
+			want:  []segmentSpec{{"/dash/1.m4s", 0, 2}, {"/dash/2.m4s", 2, 2}},
+		},
+		{
+			name:   "dynamic negative repeat to the period end",
+			doc:    live,
+			tmpl:   mpdSegmentTemplate{Timescale: 1},
+			s:      []mpdTimelineEntry{{T: uint64p(0), D: 2, R: -1}},
+			start:  10,
+			period: 4,
+			want:   []segmentSpec{{"/dash/1.m4s", 0, 2}, {"/dash/2.m4s", 2, 2}},
+		},
+		{
+			name:  "dynamic period not started",
+			doc:   live,
+			tmpl:  mpdSegmentTemplate{Timescale: 1},
+			s:     []mpdTimelineEntry{{T: uint64p(0), D: 2, R: -1}},
+			start: 60,
+		},
+		{
+			name: "dynamic long running",
+			doc:  mpdDocument{Type: "dynamic", AvailabilityStartTime: "1970-01-01T00:00:00Z"},
+			tmpl: mpdSegmentTemplate{Timescale: 1, StartNumber: uint64p(0)},
+			s:    []mpdTimelineEntry{{T: uint64p(0), D: 60, R: -1}},
+			want: []segmentSpec{
+				{"/dash/26297271.m4s", 1577836260, 60}, {"/dash/26297272.m4s", 1577836320, 60},
+				{"/dash/26297273.m4s", 1577836380, 60}, {"/dash/26297274.m4s", 1577836440, 60},
+				{"/dash/26297275.m4s", 1577836500, 60}, {"/dash/26297276.m4s", 1577836560, 60},
+				{"/dash/26297277.m4s", 1577836620, 60}, {"/dash/26297278.m4s", 1577836680, 60},
+				{"/dash/26297279.m4s", 1577836740, 60}, {"/dash/26297280.m4s", 1577836800, 60},
+			},
+		},
+		{
+			name: "dynamic without availabilityStartTime",
+			doc:  mpdDocument{Type: "dynamic"},
+			s:    []mpdTimelineEntry{{T: uint64p(0), D: 2, R: -1}},
+			err:  true,
+		},
+		{
+			name: "entry without duration",
+			s:    []mpdTimelineEntry{{T: uint64p(0)}},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		tmpl := tt.tmpl
+		tmpl.Media = "$Number$.m4s"
+		tmpl.SegmentTimeline = &mpdSegmentTimeline{S: tt.s}
+		got, err := templateTrack(&tmpl).timelineSegments(&tt.doc, tt.start, tt.period, now)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		checkSegments(t, tt.name, got, tt.want)
+	}
+}
+
+func TestNumberSegments(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)
+	ast := now.Add(-25 * time.Second).Format(time.RFC3339)
+
+	tests := []struct {
+		name   string
+		doc    mpdDocument
+		tmpl   mpdSegmentTemplate
+		start  float64
+		period float64
+		first  string // path of the first segment
+		count  int
+		err    bool
+	}{
+		{
+			name:   "static",
+			tmpl:   mpdSegmentTemplate{Timescale: 1000, Duration: 2000},
+			period: 6,
+			first:  "/dash/seg00001.m4s",
+			count:  3,
+		},
+		{
+			name:   "static partial last segment",
+			tmpl:   mpdSegmentTemplate{Timescale: 1000, Duration: 2000, StartNumber: uint64p(0)},
+			period: 5,
+			first:  "/dash/seg00000.m4s",
+			count:  3,
+		},
+		{
+			// 12 segments are complete 25 s after the start, the last 10 are listed
+			name:  "dynamic window",
+			doc:   mpdDocument{Type: "dynamic", AvailabilityStartTime: ast},
+			tmpl:  mpdSegmentTemplate{Timescale: 1, Duration: 2},
+			first: "/dash/seg00003.m4s",
+			count: 10,
+		},
+		{
+			name:  "dynamic period start",
+			doc:   mpdDocument{Type: "dynamic", AvailabilityStartTime: ast},
+			tmpl:  mpdSegmentTemplate{Timescale: 1, Duration: 2},
+			start: 20,
+			first: "/dash/seg00001.m4s",
+			count: 2,
+		},
+		{
+			name:  "dynamic before the first segment ends",
+			doc:   mpdDocument{Type: "dynamic", AvailabilityStartTime: ast},
+			tmpl:  mpdSegmentTemplate{Timescale: 1, Duration: 30},
+			count: 0,
+		},
+		{
+			name: "dynamic without availabilityStartTime",
+			doc:  mpdDocument{Type: "dynamic"},
+			tmpl: mpdSegmentTemplate{Timescale: 1, Duration: 2},
+			err:  true,
+		},
+		{
+			name: "no duration",
+			tmpl: mpdSegmentTemplate{Timescale: 1},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		tmpl := tt.tmpl
+		tmpl.Media = "seg$Number%05d$.m4s"
+		got, err := templateTrack(&tmpl).numberSegments(&tt.doc, tt.start, tt.period, now)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(got) != tt.count {
+			t.Errorf("%s: %d segments, want %d", tt.name, len(got), tt.count)
+			continue
+		}
+		if len(got) > 0 && got[0].url.Path != tt.first {
+			t.Errorf("%s: first segment %s, want %s", tt.name, got[0].url.Path, tt.first)
+		}
+	}
+}
+
+// sidxReference is a subsegment reference of a test sidx box
+type sidxReference struct {
+	size     uint32
+	duration uint32
+	index    bool // references another sidx
+}
+
+func sidxBox(version byte, timescale uint32, earliest, offset uint64, refs []sidxReference) []byte {
+	var body []byte
+	body = append(body, version, 0, 0, 0)
+	body = binary.BigEndian.AppendUint32(body, 1) // reference_ID
+	body = binary.BigEndian.AppendUint32(body, timescale)
+	if version == 0 {
+		body = binary.BigEndian.AppendUint32(body, uint32(earliest))
+		body = binary.BigEndian.AppendUint32(body, uint32(offset))
+	} else {
+		body = binary.BigEndian.AppendUint64(body, earliest)
+		body = binary.BigEndian.AppendUint64(body, offset)
+	}
+	body = binary.BigEndian.AppendUint16(body, 0) // reserved
+	body = binary.BigEndian.AppendUint16(body, uint16(len(refs)))
+	for _, ref := range refs {
+		v := ref.size
+		if ref.index {
+			v |= 0x80000000
+		}
+		body = binary.BigEndian.AppendUint32(body, v)
+		body = binary.BigEndian.AppendUint32(body, ref.duration)
+		body = binary.BigEndian.AppendUint32(body, 0x90000000) // starts with SAP
+	}
+
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, "sidx"...)
+	return append(box, body...)
+}
+
+func TestParseSidx(t *testing.T) {
+	u, _ := url.Parse("http://edge/dash/v1.mp4")
+	refs := []sidxReference{{size: 1000, duration: 96000}, {size: 1500, duration: 48000}}
+
+	type rangeSpec struct {
+		offset, limit int64
+		start         float64
+		duration      float64
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want []rangeSpec
+		err  bool
+	}{
+		{
+			name: "version 0",
+			data: sidxBox(0, 48000, 0, 0, refs),
+			want: []rangeSpec{{800, 1000, 0, 2}, {1800, 1500, 2, 1}},
+		},
+		{
+			name: "version 1 with first offset and earliest time",
+			data: sidxBox(1, 48000, 48000*10, 200, refs),
+			want: []rangeSpec{{1000, 1000, 10, 2}, {2000, 1500, 12, 1}},
+		},
+		{
+			name: "version 1 with 64 bit earliest time",
+			data: sidxBox(1, 1, 1<<33, 0, refs[:1]),
+			want: []rangeSpec{{800, 1000, 1 << 33, 96000}},
+		},
+		{
+			name: "no references",
+			data: sidxBox(0, 1000, 0, 0, nil),
+		},
+		{name: "hierarchical", data: sidxBox(0, 1000, 0, 0, []sidxReference{{size: 100, duration: 1, index: true}}), err: true},
+		{name: "zero timescale", data: sidxBox(0, 0, 0, 0, refs), err: true},
+		{name: "not a sidx", data: append([]byte{0, 0, 0, 16}, "moof\x00\x00\x00\x00\x00\x00\x00\x00"...), err: true},
+		{name: "short header", data: sidxBox(1, 1000, 0, 0, refs)[:30], err: true},
+		{name: "truncated references", data: func() []byte { b := sidxBox(0, 1000, 0, 0, refs); return b[:len(b)-4] }(), err: true},
+		{name: "too short", data: []byte("sidx"), err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSidx(tt.data, u, 800)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d segments, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for idx, seg := range got {
+			w := tt.want[idx]
+			if seg.rng.offset != w.offset || seg.rng.limit != w.limit || seg.start != w.start || seg.duration != w.duration {
+				t.Errorf("%s: segment %d = %d@%d %g+%g, want %d@%d %g+%g", tt.name, idx,
+					seg.rng.limit, seg.rng.offset, seg.start, seg.duration, w.limit, w.offset, w.start, w.duration)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// hostResolver resolves the hosts sessions connect to and times the lookups
+type hostResolver struct {
+	resolver  *net.Resolver
+	overrides map[string]string // host:port -> ip, like curl --resolve
+}
+
+// newHostResolver uses the dns server at server, the system resolver when empty.
+func newHostResolver(server string, overrides map[string]string) *hostResolver {
+	r := &hostResolver{resolver: net.DefaultResolver, overrides: overrides}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+// parseResolve parses comma separated host:port:ip overrides.
+func parseResolve(text string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, v := range strings.Split(text, ",") {
+		v = strings.TrimSpace(v)
+		data := strings.SplitN(v, ":", 3)
+		if len(data) != 3 {
+			return nil, fmt.Errorf("invalid resolve : %s", v)
+		}
+
+		ip := strings.TrimSuffix(strings.TrimPrefix(data[2], "["), "]")
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid resolve ip : %s", v)
+		}
+		overrides[net.JoinHostPort(data[0], data[1])] = ip
+	}
+	return overrides, nil
+}
+
+// lookup returns the addresses of host, s caches them for the session and may be nil.
+func (r *hostResolver) lookup(ctx context.Context, host, port string, s *session) ([]string, error) {
+	if ip, ok := r.overrides[net.JoinHostPort(host, port)]; ok {
+		return []string{ip}, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	if s != nil {
+		s.mu.Lock()
+		ips, ok := s.hosts[host]
+		s.mu.Unlock()
+		if ok {
+			return ips, nil
+		}
+	}
+
+	start := time.Now()
+	// LookupIPAddr reports to the httptrace of the request
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	elapsed := time.Now().Sub(start)
+	if err != nil {
+		stats.fail("dns")
+		requestTimings.lookup(host, 0, true)
+		if s != nil {
+			s.fail("dns")
+		}
+		return nil, err
+	}
+
+	ips := make([]string, len(addrs))
+	for idx, addr := range addrs {
+		ips[idx] = addr.String()
+	}
+
+	// the latency histogram is run wide, the request breakdown has the per host lookups
+	stats.observe("dns", elapsed)
+	requestTimings.lookup(host, elapsed, false)
+	if s != nil {
+		s.mu.Lock()
+		s.hosts[host] = ips
+		s.dnsLookups++
+		s.dnsTime += elapsed
+		s.mu.Unlock()
+		log.Printf("[%d] dns %s: %s in %d ms", s.n, host, strings.Join(ips, " "), int(elapsed)/1000000)
+	}
+	return ips, nil
+}
+
+// dial resolves the host of addr and dials its addresses in order until one connects.
+func (r *hostResolver) dial(dialer *net.Dialer, s *session) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := r.lookup(ctx, host, port, s)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
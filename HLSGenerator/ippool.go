@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// source address allocation of an ip pool
+const (
+	allocRoundRobin = "round-robin"
+	allocRandom     = "random"
+)
+
+// ipRange is size consecutive addresses starting at first
+type ipRange struct {
+	first net.IP
+	size  uint64
+}
+
+// addIP returns ip advanced by offset addresses.
+func addIP(ip net.IP, offset uint64) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for idx := len(next) - 1; idx >= 0 && offset > 0; idx-- {
+		sum := uint64(next[idx]) + offset&0xff
+		next[idx] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	return next
+}
+
+// ipDistance returns the number of addresses from first to last, ok is false if it does not fit.
+func ipDistance(first, last net.IP) (uint64, bool) {
+	if len(first) != len(last) {
+		return 0, false
+	}
+	var d uint64
+	borrow := 0
+	for idx := len(first) - 1; idx >= 0; idx-- {
+		diff := int(last[idx]) - int(first[idx]) - borrow
+		borrow = 0
+		if diff < 0 {
+			diff += 256
+			borrow = 1
+		}
+		shift := uint(len(first)-1-idx) * 8
+		if diff != 0 && shift >= 64 {
+			return 0, false
+		}
+		d += uint64(diff) << shift
+	}
+	return d, borrow == 0
+}
+
+func parseIP(v string) (net.IP, error) {
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip : %s", v)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// parseIPRange parses a CIDR (10.1.0.0/20), a range (10.1.0.1-10.1.0.200) or a single address.
+// the network and broadcast addresses of an ipv4 CIDR are left out.
+func parseIPRange(v string) (ipRange, error) {
+	switch {
+	case strings.Contains(v, "/"):
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return ipRange{}, err
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones >= 64 {
+			return ipRange{}, fmt.Errorf("ip range too large : %s", v)
+		}
+		first := network.IP
+		size := uint64(1) << uint(bits-ones)
+		if bits == 32 && size > 2 {
+			first = addIP(first, 1)
+			size -= 2
+		}
+		return ipRange{first: first, size: size}, nil
+
+	case strings.Contains(v, "-"):
+		bounds := strings.SplitN(v, "-", 2)
+		first, err := parseIP(bounds[0])
+		if err != nil {
+			return ipRange{}, err
+		}
+		last, err := parseIP(bounds[1])
+		if err != nil {
+			return ipRange{}, err
+		}
+		d, ok := ipDistance(first, last)
+		if !ok || d == ^uint64(0) {
+			return ipRange{}, fmt.Errorf("invalid ip range : %s", v)
+		}
+		return ipRange{first: first, size: d + 1}, nil
+	}
+
+	ip, err := parseIP(v)
+	if err != nil {
+		return ipRange{}, err
+	}
+	return ipRange{first: ip, size: 1}, nil
+}
+
+// isIPPool reports whether a generation info ClientIP column holds more than one address.
+// host names like client-1.lab are resolved as before, a - only makes a range between two ips.
+func isIPPool(v string) bool {
+	if strings.ContainsAny(v, "/,") {
+		return true
+	}
+	bounds := strings.SplitN(v, "-", 2)
+	return len(bounds) == 2 && net.ParseIP(bounds[0]) != nil && net.ParseIP(bounds[1]) != nil
+}
+
+// ipPool hands out a distinct local bind address per session while it has free ones
+type ipPool struct {
+	mu     sync.Mutex
+	ranges []ipRange
+	size   uint64
+	alloc  string
+	next   uint64
+	inUse  map[uint64]int // sessions per address index
+	rnd    *rand.Rand
+}
+
+// newIPPool parses comma separated ranges, see parseIPRange.
+func newIPPool(text string, alloc string) (*ipPool, error) {
+	if alloc != allocRoundRobin && alloc != allocRandom {
+		return nil, fmt.Errorf("invalid ip allocation : %s", alloc)
+	}
+
+	p := &ipPool{
+		alloc: alloc,
+		inUse: make(map[uint64]int),
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, v := range strings.Split(text, ",") {
+		r, err := parseIPRange(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if p.size+r.size < p.size {
+			return nil, fmt.Errorf("ip pool too large : %s", text)
+		}
+		p.ranges = append(p.ranges, r)
+		p.size += r.size
+	}
+	return p, nil
+}
+
+func (p *ipPool) address(idx uint64) net.IP {
+	for _, r := range p.ranges {
+		if idx < r.size {
+			return addIP(r.first, idx)
+		}
+		idx -= r.size
+	}
+	return nil
+}
+
+// allocate returns a free address of the pool, once every address is taken they are shared.
+func (p *ipPool) allocate() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	if p.alloc == allocRandom {
+		start = uint64(p.rnd.Int63()) % p.size
+	}
+
+	idx := start
+	// a full scan only happens with a nearly exhausted pool
+	if uint64(len(p.inUse)) < p.size {
+		for p.inUse[idx] > 0 {
+			idx = (idx + 1) % p.size
+		}
+	}
+	p.inUse[idx]++
+	p.next = (idx + 1) % p.size
+
+	return p.address(idx).String()
+}
+
+// release returns ip to the pool.
+func (p *ipPool) release(ip string) {
+	addr, err := parseIP(ip)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var base uint64
+	for _, r := range p.ranges {
+		if d, ok := ipDistance(r.first, addr); ok && d < r.size {
+			// a shared address stays taken until its last session releases it
+			if p.inUse[base+d]--; p.inUse[base+d] <= 0 {
+				delete(p.inUse, base+d)
+			}
+			return
+		}
+		base += r.size
+	}
+}
+
+// bindIP returns the local address the session binds to for cfg.
+// a session keeps its address from a pool until it moves to an entry with another pool.
+func (s *session) bindIP(cfg configInfo) string {
+	pool := s.cfg.ipPool
+	if pool == nil {
+		pool = cfg.pool
+	}
+	if pool == s.pool && pool != nil {
+		return s.ip
+	}
+
+	s.releaseIP()
+	if pool == nil {
+		return cfg.destIP
+	}
+	s.pool = pool
+	s.ip = pool.allocate()
+	return s.ip
+}
+
+// releaseIP returns the pool address of the session.
+func (s *session) releaseIP() {
+	if s.pool != nil {
+		s.pool.release(s.ip)
+		s.pool = nil
+		s.ip = ""
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// encryption methods of EXT-X-KEY
+const (
+	keyNone   = "NONE"
+	keyAES128 = "AES-128"
+)
+
+// inheritKeys applies each EXT-X-KEY to the following segments up to the next EXT-X-KEY,
+// the decoder only links a key to the segment right after the tag.
+func inheritKeys(mediapl *m3u8.MediaPlaylist) {
+	var key *m3u8.Key
+	for _, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		if segment.Key != nil {
+			key = segment.Key
+		}
+		if key != nil && key.Method == keyNone {
+			segment.Key = nil
+			continue
+		}
+		segment.Key = key
+	}
+}
+
+// getKey returns the key for k, fetching it once per key URI per session.
+func getKey(k *m3u8.Key, base *url.URL, s *session) ([]byte, error) {
+	keyURL, err := absolutize(k.URI, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyURL.Scheme != "http" && keyURL.Scheme != "https" {
+		// DRM key systems (skd://, data:) are not fetched over HTTP
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	key, ok := s.keys[keyURL.String()]
+	s.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	start := time.Now()
+	err = s.retry("key", func() error {
+		start = time.Now()
+		key, err = fetchKey(k, keyURL, s)
+		return err
+	})
+	if err != nil {
+		s.fail("key")
+		return nil, err
+	}
+
+	stats.observe("key", time.Now().Sub(start))
+	log.Printf("[%d] key response time: %d ms", s.n, (int(time.Now().Sub(start)) / 1000000))
+
+	s.mu.Lock()
+	s.keys[keyURL.String()] = key
+	s.mu.Unlock()
+	return key, nil
+}
+
+func fetchKey(k *m3u8.Key, keyURL *url.URL, s *session) ([]byte, error) {
+	content, _, err := getContent(keyURL, s.client, "key")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Method == keyAES128 && len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d for %v", len(key), keyURL.String())
+	}
+	return key, nil
+}
+
+// keyIV returns the IV attribute or, when absent, the media sequence number as IV.
+func keyIV(k *m3u8.Key, seq uint64) ([]byte, error) {
+	if k.IV == "" {
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], seq)
+		return iv, nil
+	}
+
+	raw := strings.TrimPrefix(strings.TrimPrefix(k.IV, "0x"), "0X")
+	iv, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IV %s", k.IV)
+	}
+	if len(iv) > aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV %s", k.IV)
+	}
+	if len(iv) < aes.BlockSize {
+		iv = append(make([]byte, aes.BlockSize-len(iv)), iv...)
+	}
+	return iv, nil
+}
+
+// segmentDecrypter decrypts an AES-128 segment while it is being read.
+type segmentDecrypter struct {
+	block   cipher.Block
+	iv      []byte
+	mode    cipher.BlockMode
+	pending []byte
+	first   byte
+	out     int64
+}
+
+func newSegmentDecrypter(key, iv []byte) (*segmentDecrypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentDecrypter{block: block, iv: iv, mode: cipher.NewCBCDecrypter(block, iv)}, nil
+}
+
+// reset starts over for a new download of the segment.
+func (d *segmentDecrypter) reset() {
+	d.mode = cipher.NewCBCDecrypter(d.block, d.iv)
+	d.pending = nil
+	d.first = 0
+	d.out = 0
+}
+
+// decrypt returns the plaintext of all complete blocks received so far.
+// the last block is held back until finish because it carries the padding.
+func (d *segmentDecrypter) decrypt(p []byte) []byte {
+	d.pending = append(d.pending, p...)
+
+	n := len(d.pending) - len(d.pending)%aes.BlockSize
+	if n == len(d.pending) {
+		n -= aes.BlockSize
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	plain := make([]byte, n)
+	d.mode.CryptBlocks(plain, d.pending[:n])
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	d.track(plain)
+	return plain
+}
+
+// finish decrypts the last block and removes the PKCS7 padding.
+func (d *segmentDecrypter) finish() ([]byte, error) {
+	if len(d.pending) != aes.BlockSize {
+		return nil, fmt.Errorf("encrypted size is not a multiple of %d", aes.BlockSize)
+	}
+
+	plain := make([]byte, aes.BlockSize)
+	d.mode.CryptBlocks(plain, d.pending)
+	d.pending = nil
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, fmt.Errorf("invalid padding")
+		}
+	}
+	plain = plain[:len(plain)-pad]
+	d.track(plain)
+
+	if d.out == 0 {
+		return nil, fmt.Errorf("empty plaintext")
+	}
+	if d.first != 0x47 {
+		return nil, fmt.Errorf("plaintext starts with 0x%02x, not a ts sync byte", d.first)
+	}
+	return plain, nil
+}
+
+func (d *segmentDecrypter) track(plain []byte) {
+	if d.out == 0 && len(plain) > 0 {
+		d.first = plain[0]
+	}
+	d.out += int64(len(plain))
+}
+
+type decryptStats struct {
+	mu       sync.Mutex
+	segments int64
+	failed   int64
+}
+
+var decryption = &decryptStats{}
+
+func (s *decryptStats) record(failed bool) {
+	s.mu.Lock()
+	s.segments++
+	if failed {
+		s.failed++
+	}
+	s.mu.Unlock()
+}
+
+func (s *decryptStats) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Printf("decryption: %d segments, %d failed", s.segments, s.failed)
+}
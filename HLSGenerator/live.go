@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// liveTracker follows a sliding live playlist by EXT-X-MEDIA-SEQUENCE.
+type liveTracker struct {
+	s      *session
+	delay  int    // segments behind the live edge to start at
+	next   uint64 // media sequence number of the next segment to play
+	start  bool
+	edge   uint64 // media sequence number of the newest segment seen
+	change time.Time
+	stall  bool
+
+	position float64 // media time played since the live start
+
+	stalls  int
+	skipped int
+}
+
+func newLiveTracker(s *session, delay int) *liveTracker {
+	return &liveTracker{s: s, delay: delay}
+}
+
+// pending returns the segments of mediapl that were not played yet.
+// the first call positions the tracker delay segments behind the live edge.
+func (l *liveTracker) pending(mediapl *m3u8.MediaPlaylist) []*m3u8.MediaSegment {
+	var segments []*m3u8.MediaSegment
+	for _, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		segments = append(segments, segment)
+	}
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	first := mediapl.SeqNo
+	edge := first + uint64(len(segments)) - 1
+
+	if !l.start {
+		l.start = true
+		l.next = first
+		if len(segments) > l.delay {
+			l.next = edge + 1 - uint64(l.delay)
+		}
+		l.edge = edge
+		l.change = time.Now()
+		log.Printf("[%d] live start at sequence %d (edge %d)", l.s.n, l.next, edge)
+	}
+
+	if edge > l.edge {
+		if l.stall {
+			stats.observe("live stall", time.Now().Sub(l.change))
+			log.Printf("[%d] live playlist resumed after %d ms", l.s.n, int(time.Now().Sub(l.change))/1000000)
+			l.stall = false
+		}
+		l.edge = edge
+		l.change = time.Now()
+	}
+
+	if l.next < first {
+		log.Printf("[%d] fell behind live window, skipping %d segments", l.s.n, first-l.next)
+		l.skipped += int(first - l.next)
+		l.next = first
+	}
+
+	if l.next > edge {
+		return nil
+	}
+	return segments[l.next-first:]
+}
+
+// checkStall reports a stall once no new segment appeared for three target durations.
+func (l *liveTracker) checkStall(mediapl *m3u8.MediaPlaylist) {
+	limit := 3 * time.Duration(mediapl.TargetDuration*float64(time.Second))
+	if !l.stall && time.Now().Sub(l.change) > limit {
+		l.stall = true
+		l.stalls++
+		log.Printf("[%d] live playlist stalled at sequence %d", l.s.n, l.edge)
+	}
+}
+
+// reloadWait returns how long to wait before the next playlist reload.
+// an unchanged playlist is reloaded after half the target duration.
+func reloadWait(mediapl *m3u8.MediaPlaylist, changed bool, last time.Time) time.Duration {
+	interval := time.Duration(mediapl.TargetDuration * float64(time.Second))
+	if !changed {
+		interval /= 2
+	}
+	return interval - time.Now().Sub(last)
+}
+
+func fixedURL(u *url.URL) func() (*url.URL, error) {
+	return func() (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// playLive plays every new segment of a live playlist once for t seconds.
+// playlistURL returns the playlist to reload, played is called after each segment
+// and returns true when the playlist to follow has changed.
+func playLive(s *session, t int, delay int, mediapl *m3u8.MediaPlaylist, msURL *url.URL, playlistURL func() (*url.URL, error), played func(size int64, elapsed time.Duration, duration float64) bool) error {
+	return followLive(s, t, delay, mediapl, msURL, playlistURL, nil, played)
+}
+
+// followLive plays a live playlist as the main track or, when r is set,
+// as a rendition that follows the media time of the main track.
+func followLive(s *session, t int, delay int, mediapl *m3u8.MediaPlaylist, msURL *url.URL, playlistURL func() (*url.URL, error), r *rendition, played func(size int64, elapsed time.Duration, duration float64) bool) error {
+	l := newLiveTracker(s, delay)
+	end := time.Now().Add(time.Duration(t) * time.Second)
+	loaded := time.Now()
+	var paused time.Time // the viewer pauses until
+	zap := false
+
+	for time.Now().Before(end) && !s.stopped() {
+		changed := false
+		switched := false
+
+		pending := l.pending(mediapl)
+		if time.Now().Before(paused) {
+			// paused, the playlist is still refreshed
+			pending = nil
+		} else if !paused.IsZero() {
+			s.buffer.hold(time.Now(), false)
+			paused = time.Time{}
+		}
+
+		for _, segment := range pending {
+			f := segment.Duration
+			if r != nil {
+				if !r.clock.wait(l.position, s) {
+					return nil
+				}
+				f = 0
+			}
+
+			phase := "segment"
+			if r != nil {
+				phase = r.phase()
+			}
+			size, elapsed, err := downloadSegment(segment, l.next, msURL, s, f, phase)
+			if err != nil {
+				return err
+			}
+
+			if r != nil {
+				r.segments++
+			}
+			l.next++
+			l.position += segment.Duration
+			changed = true
+			if played != nil && played(size, elapsed, segment.Duration) {
+				switched = true
+				break
+			}
+			if !time.Now().Before(end) || s.stopped() {
+				break
+			}
+
+			if r == nil {
+				step := s.viewer.next(segment.Duration)
+				if step.kind == actionZap {
+					zap = true
+					break
+				}
+				if step.kind == actionPause {
+					log.Printf("[%d] pause %v", s.n, step.duration)
+					s.buffer.hold(time.Now(), true)
+					paused = time.Now().Add(step.duration)
+					break
+				}
+			}
+		}
+
+		if !time.Now().Before(end) || s.stopped() || zap {
+			break
+		}
+
+		if changed {
+			// caught up with the edge, the stall clock starts now
+			l.change = time.Now()
+		}
+
+		if mediapl.Closed && !switched {
+			log.Printf("[%d] live playlist ended", s.n)
+			break
+		}
+
+		//m3u8 update
+		l.checkStall(mediapl)
+		if wait := reloadWait(mediapl, changed, loaded); wait > 0 && !switched {
+			s.sleep(wait)
+		}
+		if s.stopped() {
+			break
+		}
+
+		var err error
+		msURL, err = playlistURL()
+		if err != nil {
+			return err
+		}
+
+		loaded = time.Now()
+		mediapl, err = getMediaPlaylist(msURL, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.stall {
+		stats.observe("live stall", time.Now().Sub(l.change))
+	}
+	log.Printf("[%d] live: %d stalls, %d segments skipped", s.n, l.stalls, l.skipped)
+
+	if zap {
+		s.zap = true
+	}
+
+	return nil
+}
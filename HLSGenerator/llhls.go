@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+var errNotLowLatency = errors.New("no EXT-X-PART-INF, not a low latency playlist")
+
+// llPart is an EXT-X-PART or the EXT-X-PRELOAD-HINT of the next part
+type llPart struct {
+	msn         uint64 // media sequence number of the parent segment
+	index       int    // part number within the parent segment
+	uri         string
+	duration    float64
+	independent bool
+	gap         bool
+	rng         *byteRange
+	key         *m3u8.Key // EXT-X-KEY in effect, nil when not encrypted
+}
+
+// llPlaylist is what low latency playback needs of a media playlist.
+// the grafov decoder drops the LL-HLS tags, so the playlist is parsed here.
+type llPlaylist struct {
+	seqNo          uint64
+	targetDuration float64
+	partTarget     float64
+	partHoldBack   float64
+	canBlock       bool // EXT-X-SERVER-CONTROL CAN-BLOCK-RELOAD
+	closed         bool
+	next           uint64 // media sequence number after the last complete segment
+	parts          []llPart
+	hint           *llPart
+	initURI        string
+	initRange      *byteRange
+}
+
+// parseAttributes parses an attribute list, quoted values may contain commas.
+func parseAttributes(line string) map[string]string {
+	attrs := make(map[string]string)
+	for len(line) > 0 {
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				value, line = line[1:], ""
+			} else {
+				value, line = line[1:end+1], line[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(line, ',')
+			if end < 0 {
+				value, line = line, ""
+			} else {
+				value, line = line[:end], line[end:]
+			}
+		}
+		attrs[key] = value
+		line = strings.TrimPrefix(line, ",")
+	}
+	return attrs
+}
+
+// parsePartRange parses a BYTERANGE attribute, without "@offset" the range
+// continues the previous range of the same resource.
+func parsePartRange(v string, uri string, prev *llPart) (*byteRange, error) {
+	data := strings.SplitN(v, "@", 2)
+	limit, err := strconv.ParseInt(data[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BYTERANGE %s", v)
+	}
+
+	r := &byteRange{limit: limit}
+	if len(data) == 2 {
+		if r.offset, err = strconv.ParseInt(data[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid BYTERANGE %s", v)
+		}
+	} else if prev != nil && prev.uri == uri && prev.rng != nil {
+		r.offset = prev.rng.offset + prev.rng.limit
+	}
+	return r, nil
+}
+
+func parseLowLatency(r io.Reader) (*llPlaylist, error) {
+	pl := &llPlaylist{}
+	segments := 0 // complete segments so far
+	parts := 0    // parts of the segment in progress
+	inSegment := false
+	var key *m3u8.Key
+
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("Not a valid playlist")
+			}
+			first = false
+			continue
+		}
+
+		tag := line
+		value := ""
+		if idx := strings.IndexByte(line, ':'); idx >= 0 && strings.HasPrefix(line, "#") {
+			tag, value = line[:idx], line[idx+1:]
+		}
+
+		switch tag {
+		case "#EXT-X-MEDIA-SEQUENCE":
+			seq, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", line)
+			}
+			pl.seqNo = seq
+		case "#EXT-X-TARGETDURATION":
+			pl.targetDuration, _ = strconv.ParseFloat(value, 64)
+		case "#EXT-X-PART-INF":
+			pl.partTarget, _ = strconv.ParseFloat(parseAttributes(value)["PART-TARGET"], 64)
+		case "#EXT-X-SERVER-CONTROL":
+			attrs := parseAttributes(value)
+			pl.canBlock = attrs["CAN-BLOCK-RELOAD"] == "YES"
+			pl.partHoldBack, _ = strconv.ParseFloat(attrs["PART-HOLD-BACK"], 64)
+		case "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			pl.initURI = attrs["URI"]
+			if v, ok := attrs["BYTERANGE"]; ok {
+				r, err := parsePartRange(v, "", nil)
+				if err != nil {
+					return nil, err
+				}
+				pl.initRange = r
+			}
+		case "#EXT-X-KEY":
+			attrs := parseAttributes(value)
+			key = nil
+			if attrs["METHOD"] != keyNone {
+				key = &m3u8.Key{Method: attrs["METHOD"], URI: attrs["URI"], IV: attrs["IV"],
+					Keyformat: attrs["KEYFORMAT"], Keyformatversions: attrs["KEYFORMATVERSIONS"]}
+			}
+		case "#EXT-X-PART":
+			attrs := parseAttributes(value)
+			part := llPart{
+				msn:         pl.seqNo + uint64(segments),
+				index:       parts,
+				uri:         attrs["URI"],
+				independent: attrs["INDEPENDENT"] == "YES",
+				gap:         attrs["GAP"] == "YES",
+				key:         key,
+			}
+			var err error
+			if part.duration, err = strconv.ParseFloat(attrs["DURATION"], 64); err != nil || part.uri == "" {
+				return nil, fmt.Errorf("invalid %s", line)
+			}
+			if v, ok := attrs["BYTERANGE"]; ok {
+				var prev *llPart
+				if len(pl.parts) > 0 {
+					prev = &pl.parts[len(pl.parts)-1]
+				}
+				if part.rng, err = parsePartRange(v, part.uri, prev); err != nil {
+					return nil, err
+				}
+			}
+			pl.parts = append(pl.parts, part)
+			parts++
+		case "#EXT-X-PRELOAD-HINT":
+			attrs := parseAttributes(value)
+			if attrs["TYPE"] != "PART" || attrs["URI"] == "" {
+				break
+			}
+			hint := &llPart{msn: pl.seqNo + uint64(segments), index: parts, uri: attrs["URI"], key: key}
+			if start, ok := attrs["BYTERANGE-START"]; ok {
+				// an open ended range can not be requested as a byteRange
+				length, ok := attrs["BYTERANGE-LENGTH"]
+				if !ok {
+					break
+				}
+				r, err := parsePartRange(length+"@"+start, hint.uri, nil)
+				if err != nil {
+					return nil, err
+				}
+				hint.rng = r
+			}
+			pl.hint = hint
+		case "#EXTINF":
+			inSegment = true
+		case "#EXT-X-ENDLIST":
+			pl.closed = true
+		default:
+			if line != "" && !strings.HasPrefix(line, "#") && inSegment {
+				segments++
+				parts = 0
+				inSegment = false
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if pl.partTarget <= 0 {
+		return nil, errNotLowLatency
+	}
+	pl.next = pl.seqNo + uint64(segments)
+	return pl, nil
+}
+
+// getLowLatencyPlaylist loads a playlist, phase tells blocking reloads apart from plain ones.
+// hold is the time the server may hold the request on top of the regular timeout.
+func getLowLatencyPlaylist(u *url.URL, s *session, phase string, hold time.Duration) (*llPlaylist, error) {
+	client := s.client
+	if hold > 0 {
+		client = holdClient(client, hold)
+	}
+
+	var body []byte
+	start := time.Now()
+	err := s.retry(phase, func() error {
+		start = time.Now()
+		resp, err := getRangeResponse(u, client, nil, phase)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		s.fail(phase)
+		return nil, err
+	}
+	elapsed := time.Now().Sub(start)
+
+	// a regular live playlist is no failure, the caller falls back to it
+	pl, err := parseLowLatency(bytes.NewReader(body))
+	if err == errNotLowLatency {
+		return nil, err
+	}
+	if err != nil {
+		stats.fail(phase)
+		s.fail(phase)
+		return nil, err
+	}
+	stats.observe(phase, elapsed)
+	return pl, nil
+}
+
+// holdClient returns a copy of c whose timeouts allow hold more for a request the server holds on purpose.
+func holdClient(c *http.Client, hold time.Duration) *http.Client {
+	held := *c
+	if held.Timeout > 0 {
+		held.Timeout += hold
+	}
+	if t, ok := held.Transport.(*headerTimeoutTransport); ok {
+		held.Transport = &headerTimeoutTransport{base: t.base, timeout: t.timeout + hold}
+	}
+	return &held
+}
+
+// blockingURL asks the server to hold the playlist until part index of segment msn is available.
+func blockingURL(u *url.URL, msn uint64, index int) *url.URL {
+	next := *u
+	query := next.Query()
+	query.Set("_HLS_msn", strconv.FormatUint(msn, 10))
+	query.Set("_HLS_part", strconv.Itoa(index))
+	next.RawQuery = query.Encode()
+	return &next
+}
+
+// llCursor is the next part to play
+type llCursor struct {
+	msn   uint64
+	index int
+}
+
+func (c llCursor) before(p llPart) bool {
+	return c.msn < p.msn || (c.msn == p.msn && c.index < p.index)
+}
+
+func (c llCursor) at(p llPart) bool {
+	return c.msn == p.msn && c.index == p.index
+}
+
+// startCursor positions playback PART-HOLD-BACK behind the end of the playlist,
+// three part targets when the server does not say.
+func startCursor(pl *llPlaylist) llCursor {
+	holdBack := pl.partHoldBack
+	if holdBack <= 0 {
+		holdBack = 3 * pl.partTarget
+	}
+
+	if len(pl.parts) == 0 {
+		return llCursor{msn: pl.next}
+	}
+
+	idx := len(pl.parts) - 1
+	for behind := 0.0; idx > 0; idx-- {
+		behind += pl.parts[idx].duration
+		if behind >= holdBack {
+			break
+		}
+	}
+	// start where a player can decode
+	for i := idx; i >= 0; i-- {
+		if pl.parts[i].independent {
+			idx = i
+			break
+		}
+	}
+	return llCursor{msn: pl.parts[idx].msn, index: pl.parts[idx].index}
+}
+
+// settle moves c past the end of a segment that is complete in pl.
+func (c llCursor) settle(pl *llPlaylist) llCursor {
+	for c.msn < pl.next {
+		last := -1
+		for _, p := range pl.parts {
+			if p.msn == c.msn {
+				last = p.index
+			}
+		}
+		if c.index <= last {
+			break
+		}
+		c = llCursor{msn: c.msn + 1}
+	}
+	return c
+}
+
+// edgeDistance returns the media time listed in pl after the part at c.
+func edgeDistance(pl *llPlaylist, c llCursor) float64 {
+	var d float64
+	for _, p := range pl.parts {
+		if !c.before(p) && !c.at(p) {
+			continue
+		}
+		d += p.duration
+	}
+	return d
+}
+
+// playLowLatency plays a low latency live playlist part by part for t seconds,
+// reloading it with blocking requests for the next part and fetching preload hints.
+// it returns errNotLowLatency for a playlist without parts, the caller plays it as regular live.
+func playLowLatency(s *session, t int, playlistURL func() (*url.URL, error), played func(size int64, elapsed time.Duration, duration float64) bool) error {
+	msURL, err := playlistURL()
+	if err != nil {
+		return err
+	}
+	pl, err := getLowLatencyPlaylist(msURL, s, "playlist", 0)
+	if err != nil {
+		return err
+	}
+
+	// "static live" becomes "static ll-hls"
+	s.kind = strings.TrimSuffix(s.kind, "live") + "ll-hls"
+	cursor := startCursor(pl)
+	log.Printf("[%d] ll-hls start at sequence %d part %d (part target %.3f s, blocking reload %v)", s.n, cursor.msn, cursor.index, pl.partTarget, pl.canBlock)
+
+	var parts, hints, reloads, skipped int
+	end := time.Now().Add(time.Duration(t) * time.Second)
+	zap := false
+
+	// play downloads one part and reports whether playback should stop
+	play := func(part llPart, base *url.URL, phase string) (bool, error) {
+		u, err := absolutize(part.uri, base)
+		if err != nil {
+			return true, err
+		}
+
+		opaque := false
+		if part.key != nil && part.key.URI != "" {
+			if _, err := getKey(part.key, base, s); err != nil {
+				return true, err
+			}
+			// a part continues the CBC chain of its parent segment, AES-128 parts are only checked by size
+			opaque = part.key.Method == keyAES128
+		}
+
+		size, elapsed, err := downloadPhase(phase, u, part.rng, s, part.duration, nil, opaque)
+		if err != nil {
+			return true, err
+		}
+		cursor = llCursor{msn: part.msn, index: part.index + 1}
+		stats.observe("part edge", time.Duration(edgeDistance(pl, cursor)*float64(time.Second)))
+
+		if played != nil && played(size, elapsed, part.duration) {
+			if msURL, err = playlistURL(); err != nil {
+				return true, err
+			}
+		}
+		if !time.Now().Before(end) || s.stopped() {
+			return true, nil
+		}
+
+		step := s.viewer.next(part.duration)
+		switch step.kind {
+		case actionZap:
+			zap = true
+			return true, nil
+		case actionPause:
+			log.Printf("[%d] pause %v", s.n, step.duration)
+			s.buffer.hold(time.Now(), true)
+			s.sleep(step.duration)
+			s.buffer.hold(time.Now(), false)
+		}
+		return false, nil
+	}
+
+	for time.Now().Before(end) && !s.stopped() {
+		if pl.initURI != "" {
+			initURL, err := absolutize(pl.initURI, msURL)
+			if err != nil {
+				return err
+			}
+			if err := getInitSection(initURL, pl.initRange, s); err != nil {
+				return err
+			}
+		}
+
+		done := false
+		for _, part := range pl.parts {
+			cursor = cursor.settle(pl)
+			if !cursor.before(part) && !cursor.at(part) {
+				continue
+			}
+			if cursor.before(part) && !cursor.at(part) {
+				// the part to play left the playlist
+				skipped++
+				log.Printf("[%d] ll-hls fell behind, skipping to sequence %d part %d", s.n, part.msn, part.index)
+			}
+			if part.gap {
+				cursor = llCursor{msn: part.msn, index: part.index + 1}
+				continue
+			}
+
+			parts++
+			if done, err = play(part, msURL, "part"); err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+		cursor = cursor.settle(pl)
+
+		if !done && pl.hint != nil && cursor.at(*pl.hint) {
+			// the request waits on the server until the part is available
+			hint := *pl.hint
+			hint.duration = pl.partTarget
+			hints++
+			if done, err = play(hint, msURL, "part"); err != nil {
+				return err
+			}
+		}
+
+		if done || zap {
+			break
+		}
+		if pl.closed {
+			log.Printf("[%d] live playlist ended", s.n)
+			break
+		}
+
+		next := msURL
+		phase := "playlist"
+		var hold time.Duration
+		if pl.canBlock {
+			next = blockingURL(msURL, cursor.msn, cursor.index)
+			phase = "blocking reload"
+			// the server may hold a blocking reload up to three target durations
+			hold = time.Duration(3 * pl.targetDuration * float64(time.Second))
+			reloads++
+		} else {
+			s.sleep(time.Duration(pl.partTarget * float64(time.Second)))
+		}
+
+		reloaded, err := getLowLatencyPlaylist(next, s, phase, hold)
+		if err != nil {
+			return err
+		}
+		pl = reloaded
+	}
+
+	log.Printf("[%d] ll-hls: %d parts, %d preload hints, %d blocking reloads, %d skips", s.n, parts, hints, reloads, skipped)
+
+	if zap {
+		s.zap = true
+	}
+	return nil
+}
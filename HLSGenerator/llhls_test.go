@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestParseAttributes(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{`DURATION=0.25,URI="part1.mp4"`, map[string]string{"DURATION": "0.25", "URI": "part1.mp4"}},
+		{`URI="a,b=c.mp4",INDEPENDENT=YES`, map[string]string{"URI": "a,b=c.mp4", "INDEPENDENT": "YES"}},
+		{`CAN-BLOCK-RELOAD=YES, PART-HOLD-BACK=1.0`, map[string]string{"CAN-BLOCK-RELOAD": "YES", "PART-HOLD-BACK": "1.0"}},
+		{`URI="",GAP=YES`, map[string]string{"URI": "", "GAP": "YES"}},
+		{`URI="open.mp4`, map[string]string{"URI": "open.mp4"}},
+		{`NOVALUE`, map[string]string{}},
+		{``, map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseAttributes(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAttributes(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePartRange(t *testing.T) {
+	prev := &llPart{uri: "seg1.mp4", rng: &byteRange{limit: 1000, offset: 500}}
+	tests := []struct {
+		name string
+		v    string
+		uri  string
+		prev *llPart
+		want *byteRange
+		err  bool
+	}{
+		{name: "offset", v: "100@50", uri: "seg1.mp4", prev: prev, want: &byteRange{limit: 100, offset: 50}},
+		{name: "continues the previous part", v: "100", uri: "seg1.mp4", prev: prev, want: &byteRange{limit: 100, offset: 1500}},
+		{name: "other resource", v: "100", uri: "seg2.mp4", prev: prev, want: &byteRange{limit: 100}},
+		{name: "previous part without range", v: "100", uri: "seg1.mp4", prev: &llPart{uri: "seg1.mp4"}, want: &byteRange{limit: 100}},
+		{name: "first part", v: "100", uri: "seg1.mp4", want: &byteRange{limit: 100}},
+		{name: "invalid length", v: "x@0", uri: "seg1.mp4", err: true},
+		{name: "invalid offset", v: "100@y", uri: "seg1.mp4", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePartRange(tt.v, tt.uri, tt.prev)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// errAny stands for any error other than errNotLowLatency
+var errAny = errors.New("any error")
+
+const llLivePlaylist = `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.75
+#EXT-X-PART-INF:PART-TARGET=0.25
+#EXT-X-MEDIA-SEQUENCE:20
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="800@0"
+#EXT-X-PART:DURATION=0.25,URI="seg20.mp4",BYTERANGE="1000@800",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.25,URI="seg20.mp4",BYTERANGE="1200"
+#EXTINF:0.5,
+seg20.mp4
+#EXT-X-PART:DURATION=0.25,URI="part21.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.25,URI="seg21.mp4",BYTERANGE="500"
+#EXT-X-PART:DURATION=0.25,URI="seg21.mp4",BYTERANGE="700"
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg21.mp4",BYTERANGE-START=1200,BYTERANGE-LENGTH=300
+`
+
+const llClosedPlaylist = `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-PART-INF:PART-TARGET=0.5
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-PART:DURATION=0.5,URI="p7.0.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.5,URI="p7.1.ts",GAP=YES
+#EXTINF:1.0,
+s7.ts
+#EXTINF:1.0,
+s8.ts
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="p9.0.ts",BYTERANGE-START=0
+#EXT-X-ENDLIST
+`
+
+func TestParseLowLatency(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want *llPlaylist
+		err  error // errNotLowLatency, or errAny for any other error
+	}{
+		{
+			name: "live with byte ranges and a preload hint",
+			text: llLivePlaylist,
+			want: &llPlaylist{
+				seqNo:          20,
+				targetDuration: 1,
+				partTarget:     0.25,
+				partHoldBack:   0.75,
+				canBlock:       true,
+				next:           21,
+				parts: []llPart{
+					{msn: 20, index: 0, uri: "seg20.mp4", duration: 0.25, independent: true, rng: &byteRange{limit: 1000, offset: 800}},
+					{msn: 20, index: 1, uri: "seg20.mp4", duration: 0.25, rng: &byteRange{limit: 1200, offset: 1800}},
+					{msn: 21, index: 0, uri: "part21.0.mp4", duration: 0.25, independent: true},
+					{msn: 21, index: 1, uri: "seg21.mp4", duration: 0.25, rng: &byteRange{limit: 500}},
+					{msn: 21, index: 2, uri: "seg21.mp4", duration: 0.25, rng: &byteRange{limit: 700, offset: 500}},
+				},
+				hint:      &llPart{msn: 21, index: 3, uri: "seg21.mp4", rng: &byteRange{limit: 300, offset: 1200}},
+				initURI:   "init.mp4",
+				initRange: &byteRange{limit: 800},
+			},
+		},
+		{
+			// segments without parts count, the open ended hint is dropped
+			name: "closed",
+			text: llClosedPlaylist,
+			want: &llPlaylist{
+				seqNo:          7,
+				targetDuration: 1,
+				partTarget:     0.5,
+				closed:         true,
+				next:           9,
+				parts: []llPart{
+					{msn: 7, index: 0, uri: "p7.0.ts", duration: 0.5, independent: true},
+					{msn: 7, index: 1, uri: "p7.1.ts", duration: 0.5, gap: true},
+				},
+			},
+		},
+		{
+			name: "encrypted",
+			text: "#EXTM3U\n#EXT-X-PART-INF:PART-TARGET=1\n#EXT-X-KEY:METHOD=AES-128,URI=\"key1\",IV=0x01\n" +
+				"#EXT-X-PART:DURATION=1,URI=\"p0.ts\"\n#EXTINF:1,\ns0.ts\n#EXT-X-KEY:METHOD=NONE\n" +
+				"#EXT-X-PART:DURATION=1,URI=\"p1.ts\"\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key2\"\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p2.ts\"\n",
+			want: &llPlaylist{
+				partTarget: 1,
+				next:       1,
+				parts: []llPart{
+					{msn: 0, index: 0, uri: "p0.ts", duration: 1, key: &m3u8.Key{Method: "AES-128", URI: "key1", IV: "0x01"}},
+					{msn: 1, index: 0, uri: "p1.ts", duration: 1},
+				},
+				hint: &llPart{msn: 1, index: 1, uri: "p2.ts", key: &m3u8.Key{Method: "SAMPLE-AES", URI: "key2"}},
+			},
+		},
+		{
+			name: "regular live playlist",
+			text: "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:6.0,\ns1.ts\n",
+			err:  errNotLowLatency,
+		},
+		{name: "not a playlist", text: "<html>\n", err: errAny},
+		{name: "invalid media sequence", text: "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:x\n", err: errAny},
+		{name: "part without uri", text: "#EXTM3U\n#EXT-X-PART-INF:PART-TARGET=1\n#EXT-X-PART:DURATION=1\n", err: errAny},
+		{name: "part without duration", text: "#EXTM3U\n#EXT-X-PART-INF:PART-TARGET=1\n#EXT-X-PART:URI=\"p.ts\"\n", err: errAny},
+		{name: "invalid part range", text: "#EXTM3U\n#EXT-X-PART-INF:PART-TARGET=1\n#EXT-X-PART:DURATION=1,URI=\"p.ts\",BYTERANGE=\"x\"\n", err: errAny},
+		{name: "invalid map range", text: "#EXTM3U\n#EXT-X-MAP:URI=\"i.mp4\",BYTERANGE=\"1@y\"\n", err: errAny},
+	}
+	for _, tt := range tests {
+		got, err := parseLowLatency(strings.NewReader(tt.text))
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.err == errAny && err == nil, tt.err == errNotLowLatency && err != errNotLowLatency:
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		case tt.err == nil && !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// llParts lists n parts of duration d per segment from msn first to last,
+// independent every step parts of a segment, none when step is 0.
+func llParts(first, last uint64, n int, d float64, step int) []llPart {
+	var parts []llPart
+	for msn := first; msn <= last; msn++ {
+		for idx := 0; idx < n; idx++ {
+			parts = append(parts, llPart{msn: msn, index: idx, duration: d, independent: step > 0 && idx%step == 0})
+		}
+	}
+	return parts
+}
+
+func TestStartCursor(t *testing.T) {
+	tests := []struct {
+		name string
+		pl   llPlaylist
+		want llCursor
+	}{
+		{
+			name: "part hold back",
+			pl:   llPlaylist{partTarget: 0.25, partHoldBack: 1, next: 12, parts: llParts(10, 11, 4, 0.25, 1)},
+			want: llCursor{msn: 11, index: 0},
+		},
+		{
+			name: "three part targets",
+			pl:   llPlaylist{partTarget: 0.25, next: 12, parts: llParts(10, 11, 4, 0.25, 1)},
+			want: llCursor{msn: 11, index: 1},
+		},
+		{
+			name: "back to an independent part",
+			pl:   llPlaylist{partTarget: 0.25, next: 12, parts: llParts(10, 11, 4, 0.25, 4)},
+			want: llCursor{msn: 11, index: 0},
+		},
+		{
+			name: "independent part in the previous segment",
+			pl:   llPlaylist{partTarget: 0.25, partHoldBack: 0.25, next: 12, parts: append(llParts(10, 11, 4, 0.25, 4), llParts(12, 12, 2, 0.25, 0)...)},
+			want: llCursor{msn: 11, index: 0},
+		},
+		{
+			name: "no independent part",
+			pl:   llPlaylist{partTarget: 0.25, partHoldBack: 0.5, next: 12, parts: llParts(10, 11, 4, 0.25, 0)},
+			want: llCursor{msn: 11, index: 2},
+		},
+		{
+			name: "hold back longer than the playlist",
+			pl:   llPlaylist{partTarget: 0.25, partHoldBack: 30, next: 12, parts: llParts(10, 11, 4, 0.25, 0)},
+			want: llCursor{msn: 10, index: 0},
+		},
+		{
+			name: "no parts",
+			pl:   llPlaylist{partTarget: 0.25, next: 12},
+			want: llCursor{msn: 12},
+		},
+	}
+	for _, tt := range tests {
+		if got := startCursor(&tt.pl); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	// segments 10 and 11 are complete, 12 has two parts so far
+	pl := &llPlaylist{next: 12, parts: append(llParts(10, 11, 4, 0.25, 1), llParts(12, 12, 2, 0.25, 1)...)}
+
+	tests := []struct {
+		name string
+		c    llCursor
+		want llCursor
+	}{
+		{"listed part", llCursor{msn: 11, index: 3}, llCursor{msn: 11, index: 3}},
+		{"past a complete segment", llCursor{msn: 11, index: 4}, llCursor{msn: 12}},
+		{"into the next listed part", llCursor{msn: 10, index: 4}, llCursor{msn: 11}},
+		{"segment without listed parts", llCursor{msn: 8, index: 0}, llCursor{msn: 10}},
+		{"segment in progress", llCursor{msn: 12, index: 2}, llCursor{msn: 12, index: 2}},
+		{"ahead of the playlist", llCursor{msn: 13}, llCursor{msn: 13}},
+	}
+	for _, tt := range tests {
+		if got := tt.c.settle(pl); got != tt.want {
+			t.Errorf("%s: %+v.settle() = %+v, want %+v", tt.name, tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segment latency histogram buckets in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// failure phases exported even before the first failure
+var failPhases = []string{"dns", "tls", "gslb", "glb", "vod", "playlist", "key", "init", "segment", "part", "audio", "subtitles"}
+
+type contentLabels struct {
+	serviceCode string
+	contentType string
+}
+
+type latencyHistogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+type runMetrics struct {
+	mu       sync.Mutex
+	active   int64
+	started  int64
+	ended    int64
+	failed   map[string]int64
+	bytes    map[contentLabels]int64
+	segments map[contentLabels]*latencyHistogram
+}
+
+var metrics = &runMetrics{
+	failed:   make(map[string]int64),
+	bytes:    make(map[contentLabels]int64),
+	segments: make(map[contentLabels]*latencyHistogram),
+}
+
+func (m *runMetrics) sessionStarted() {
+	m.mu.Lock()
+	m.active++
+	m.started++
+	m.mu.Unlock()
+}
+
+func (m *runMetrics) sessionEnded(s *session) {
+	m.mu.Lock()
+	m.active--
+	m.ended++
+	if s.failed != "" {
+		m.failed[s.failed]++
+	}
+	m.mu.Unlock()
+}
+
+func (m *runMetrics) segment(s *session, size int64, elapsed time.Duration) {
+	labels := contentLabels{s.info.serviceCode, s.info.contentType}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytes[labels] += size
+
+	h, ok := m.segments[labels]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]int64, len(latencyBuckets))}
+		m.segments[labels] = h
+	}
+
+	sec := elapsed.Seconds()
+	for idx, le := range latencyBuckets {
+		if sec <= le {
+			h.buckets[idx]++
+		}
+	}
+	h.count++
+	h.sum += sec
+}
+
+func sortedLabels(set map[contentLabels]bool) []contentLabels {
+	var labels []contentLabels
+	for l := range set {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].serviceCode != labels[j].serviceCode {
+			return labels[i].serviceCode < labels[j].serviceCode
+		}
+		return labels[i].contentType < labels[j].contentType
+	})
+	return labels
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (l contentLabels) String() string {
+	return fmt.Sprintf(`serviceCode="%s",contentType="%s"`, escapeLabel(l.serviceCode), escapeLabel(l.contentType))
+}
+
+// write renders the metrics in the Prometheus text exposition format.
+func (m *runMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP hls_active_sessions Sessions currently running.")
+	fmt.Fprintln(w, "# TYPE hls_active_sessions gauge")
+	fmt.Fprintf(w, "hls_active_sessions %d\n", m.active)
+
+	fmt.Fprintln(w, "# HELP hls_sessions_started_total Sessions started.")
+	fmt.Fprintln(w, "# TYPE hls_sessions_started_total counter")
+	fmt.Fprintf(w, "hls_sessions_started_total %d\n", m.started)
+
+	fmt.Fprintln(w, "# HELP hls_sessions_ended_total Sessions ended, including failed ones.")
+	fmt.Fprintln(w, "# TYPE hls_sessions_ended_total counter")
+	fmt.Fprintf(w, "hls_sessions_ended_total %d\n", m.ended)
+
+	fmt.Fprintln(w, "# HELP hls_sessions_failed_total Sessions ended by an error, by the phase that failed.")
+	fmt.Fprintln(w, "# TYPE hls_sessions_failed_total counter")
+	phases := append([]string{}, failPhases...)
+	for phase := range m.failed {
+		known := false
+		for _, p := range failPhases {
+			known = known || p == phase
+		}
+		if !known {
+			phases = append(phases, phase)
+		}
+	}
+	for _, phase := range phases {
+		fmt.Fprintf(w, "hls_sessions_failed_total{phase=\"%s\"} %d\n", escapeLabel(phase), m.failed[phase])
+	}
+
+	set := make(map[contentLabels]bool)
+	for l := range m.bytes {
+		set[l] = true
+	}
+	for l := range m.segments {
+		set[l] = true
+	}
+	labels := sortedLabels(set)
+
+	fmt.Fprintln(w, "# HELP hls_received_bytes_total Bytes received.")
+	fmt.Fprintln(w, "# TYPE hls_received_bytes_total counter")
+	for _, l := range labels {
+		fmt.Fprintf(w, "hls_received_bytes_total{%s} %d\n", l, m.bytes[l])
+	}
+
+	fmt.Fprintln(w, "# HELP hls_segment_latency_seconds Segment download time.")
+	fmt.Fprintln(w, "# TYPE hls_segment_latency_seconds histogram")
+	for _, l := range labels {
+		h, ok := m.segments[l]
+		if !ok {
+			continue
+		}
+		for idx, le := range latencyBuckets {
+			fmt.Fprintf(w, "hls_segment_latency_seconds_bucket{%s,le=\"%g\"} %d\n", l, le, h.buckets[idx])
+		}
+		fmt.Fprintf(w, "hls_segment_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(w, "hls_segment_latency_seconds_sum{%s} %g\n", l, h.sum)
+		fmt.Fprintf(w, "hls_segment_latency_seconds_count{%s} %d\n", l, h.count)
+	}
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+
+	go func() {
+		log.Printf("metrics listening on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("metrics server error:", err)
+		}
+	}()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// content selection modes
+const (
+	selectRoundRobin = "round-robin"
+	selectWeighted   = "weighted"
+	selectZipf       = "zipf"
+)
+
+// contentSelector assigns sessions to generation info entries
+type contentSelector struct {
+	mode    string
+	zipfS   float64
+	seed    int64 // 0 draws from the clock
+	entries []configInfo
+}
+
+// newContentSelector sets the entry weights of mode, they weigh zaps as well.
+// round-robin clears them, zipf weighs the entry of rank k, counted in file order,
+// 1/k^s and weighted keeps the weights of the scenario file.
+// an empty mode is weighted when the entries have weights, else round-robin.
+func newContentSelector(entries []configInfo, mode string, zipfS float64, seed int64) (*contentSelector, error) {
+	if mode == "" {
+		mode = selectRoundRobin
+		if entries[0].weight > 0 {
+			mode = selectWeighted
+		}
+	}
+
+	switch mode {
+	case selectRoundRobin:
+		for idx := range entries {
+			entries[idx].weight = 0
+		}
+	case selectWeighted:
+		if entries[0].weight == 0 {
+			return nil, fmt.Errorf("weighted selection needs scenario entries with weights")
+		}
+	case selectZipf:
+		if zipfS <= 0 {
+			return nil, fmt.Errorf("invalid zipf exponent : %g", zipfS)
+		}
+		for idx := range entries {
+			entries[idx].weight = 1 / math.Pow(float64(idx+1), zipfS)
+		}
+	default:
+		return nil, fmt.Errorf("invalid content selection : %s", mode)
+	}
+
+	return &contentSelector{mode: mode, zipfS: zipfS, seed: seed, entries: entries}, nil
+}
+
+// pick returns the entry of session n. with a seed the draw only depends on n,
+// so a run is reproduced whatever the order the sessions start in or the agents they run on.
+func (c *contentSelector) pick(n int) configInfo {
+	var cfg configInfo
+	if c.mode == selectRoundRobin {
+		cfg = c.entries[n%len(c.entries)]
+	} else {
+		seed := c.seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		cfg = pickWeighted(c.entries, rand.New(rand.NewSource(seed+int64(n))))
+	}
+	titles.add(cfg)
+	return cfg
+}
+
+func (c *contentSelector) String() string {
+	text := c.mode
+	if c.mode == selectZipf {
+		text += fmt.Sprintf(" s=%g", c.zipfS)
+	}
+	if c.seed != 0 && c.mode != selectRoundRobin {
+		text += fmt.Sprintf(" seed %d", c.seed)
+	}
+	return text
+}
+
+// titleCount is the number of sessions assigned to one title
+type titleCount struct {
+	ServiceCode string `json:"serviceCode"`
+	Content     string `json:"content"`
+	Sessions    int    `json:"sessions"`
+}
+
+type titleKey struct {
+	serviceCode string
+	content     string
+}
+
+type titleStats struct {
+	mu     sync.Mutex
+	counts map[titleKey]int
+}
+
+var titles = &titleStats{counts: make(map[titleKey]int)}
+
+func (t *titleStats) add(cfg configInfo) {
+	t.mu.Lock()
+	t.counts[titleKey{cfg.serviceCode, cfg.fileName}]++
+	t.mu.Unlock()
+}
+
+func (t *titleStats) dump() []titleCount {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var counts []titleCount
+	for key, n := range t.counts {
+		counts = append(counts, titleCount{ServiceCode: key.serviceCode, Content: key.content, Sessions: n})
+	}
+	return counts
+}
+
+// merge adds the counts of another process to t.
+func (t *titleStats) merge(counts []titleCount) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, c := range counts {
+		t.counts[titleKey{c.ServiceCode, c.Content}] += c.Sessions
+	}
+}
+
+// print reports the sessions per title in entry order next to the share c expects,
+// entries of the same title add up.
+func (c *contentSelector) print() {
+	var keys []titleKey
+	expected := make(map[titleKey]float64)
+	var total float64
+	for _, entry := range c.entries {
+		key := titleKey{entry.serviceCode, entry.fileName}
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+		weight := entry.weight
+		if c.mode == selectRoundRobin {
+			weight = 1
+		}
+		expected[key] += weight
+		total += weight
+	}
+
+	titles.mu.Lock()
+	defer titles.mu.Unlock()
+
+	sessions := 0
+	width := 8
+	for _, key := range keys {
+		sessions += titles.counts[key]
+		if len(key.content) > width {
+			width = len(key.content)
+		}
+	}
+	if sessions == 0 {
+		return
+	}
+
+	log.Printf("content selection %s: %d sessions, %d titles", c, sessions, len(keys))
+	log.Printf("%4s %-12s %-*s %8s %7s %8s", "rank", "service", width, "content", "sessions", "share", "expected")
+	for idx, key := range keys {
+		n := titles.counts[key]
+		log.Printf("%4d %-12s %-*s %8d %6.1f%% %7.1f%%", idx+1, key.serviceCode, width, key.content, n,
+			float64(n)/float64(sessions)*100, expected[key]/total*100)
+	}
+}
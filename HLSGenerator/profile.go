@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// load profile stage kinds
+const (
+	stageRamp = "ramp"
+	stageHold = "hold"
+)
+
+// loadStage is one step of a load profile.
+// ramp moves the target concurrency linearly to target over duration, hold keeps it.
+type loadStage struct {
+	kind     string
+	target   int
+	duration time.Duration
+}
+
+func (stage loadStage) String() string {
+	if stage.kind == stageRamp {
+		return fmt.Sprintf("%s:%d:%v", stage.kind, stage.target, stage.duration)
+	}
+	return fmt.Sprintf("%s:%v", stage.kind, stage.duration)
+}
+
+// parseProfile parses stages separated by commas or new lines, e.g.
+// "ramp:3000:10m, hold:30m, ramp:0:5m". lines starting with # are ignored.
+func parseProfile(text string) ([]loadStage, error) {
+	var stages []loadStage
+
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		data := strings.FieldsFunc(field, func(r rune) bool {
+			return r == ':' || r == ' ' || r == '\t'
+		})
+		if len(data) == 0 {
+			return nil, fmt.Errorf("invalid profile stage : %s", field)
+		}
+
+		stage := loadStage{kind: data[0]}
+		switch {
+		case stage.kind == stageRamp && len(data) == 3:
+			target, err := strconv.Atoi(data[1])
+			if err != nil || target < 0 {
+				return nil, fmt.Errorf("invalid ramp target : %s", field)
+			}
+			stage.target = target
+		case stage.kind == stageHold && len(data) == 2:
+		default:
+			return nil, fmt.Errorf("invalid profile stage : %s", field)
+		}
+
+		duration, err := time.ParseDuration(data[len(data)-1])
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid stage duration : %s", field)
+		}
+		stage.duration = duration
+
+		stages = append(stages, stage)
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("empty load profile")
+	}
+
+	return stages, nil
+}
+
+func readProfile(fileName string) ([]loadStage, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfile(string(data))
+}
+
+// profileTarget returns the target concurrency at elapsed and whether the profile is over.
+func profileTarget(stages []loadStage, elapsed time.Duration) (int, bool) {
+	current := 0
+	for _, stage := range stages {
+		if elapsed < stage.duration {
+			if stage.kind == stageRamp {
+				ratio := float64(elapsed) / float64(stage.duration)
+				return current + int(float64(stage.target-current)*ratio), false
+			}
+			return current, false
+		}
+
+		elapsed -= stage.duration
+		if stage.kind == stageRamp {
+			current = stage.target
+		}
+	}
+	return current, true
+}
+
+// runProfile keeps the number of running sessions at the profile target,
+// starting replacement sessions as others end and stopping the newest ones on ramp down.
+func runProfile(stages []loadStage, start func(n int) *session, play func(s *session)) {
+	var mu sync.Mutex
+	active := make(map[int]*session)
+	var order []int // session numbers in start order
+	wg := new(sync.WaitGroup)
+
+	begin := time.Now()
+	next := 0
+	lastLog := 0
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		target, done := profileTarget(stages, time.Now().Sub(begin))
+		if done || control.stopped() {
+			break
+		}
+
+		mu.Lock()
+		running := 0
+		for _, s := range active {
+			if !s.stopped() {
+				running++
+			}
+		}
+		for running < target {
+			s := start(next)
+			active[s.n] = s
+			order = append(order, s.n)
+			next++
+			running++
+
+			wg.Add(1)
+			go func(s *session) {
+				defer wg.Done()
+				play(s)
+
+				mu.Lock()
+				delete(active, s.n)
+				mu.Unlock()
+			}(s)
+		}
+
+		// stop the newest sessions first
+		for idx := len(order) - 1; running > target && idx >= 0; idx-- {
+			s, ok := active[order[idx]]
+			if !ok || s.stopped() {
+				continue
+			}
+			s.end()
+			running--
+		}
+
+		// forget ended sessions
+		live := order[:0]
+		for _, n := range order {
+			if s, ok := active[n]; ok && !s.stopped() {
+				live = append(live, n)
+			}
+		}
+		order = live
+		mu.Unlock()
+
+		if target != lastLog && (target%100 == 0 || target < 100) {
+			log.Printf("load profile: target %d sessions, %d started", target, next)
+			lastLog = target
+		}
+	}
+
+	log.Printf("load profile complete: %d sessions started", next)
+
+	mu.Lock()
+	for _, s := range active {
+		s.end()
+	}
+	mu.Unlock()
+
+	control.wait(wg)
+}
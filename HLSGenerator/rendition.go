@@ -0,0 +1,237 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// renditionNone disables a rendition type
+const renditionNone = "none"
+
+// renditionSelect chooses an EXT-X-MEDIA rendition of one type
+type renditionSelect struct {
+	lang  string // preferred LANGUAGE, empty picks the DEFAULT rendition
+	group string // GROUP-ID, empty uses the group of the variant
+}
+
+// mediaClock is the media time the main track of a session has requested up to.
+// rendition pipelines fetch their segments up to this position.
+type mediaClock struct {
+	from float64 // media time the main track started or seeked to
+
+	mu       sync.Mutex
+	position float64
+	done     bool
+	changed  chan struct{}
+}
+
+func newMediaClock(from float64) *mediaClock {
+	return &mediaClock{from: from, position: from, changed: make(chan struct{})}
+}
+
+func (c *mediaClock) advance(d float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.position += d
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// close ends the main track, waiting renditions stop.
+func (c *mediaClock) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.done {
+		c.done = true
+		close(c.changed)
+	}
+}
+
+// wait blocks until the main track requested past media time t.
+// it returns false when the main track ended before or the session stopped.
+func (c *mediaClock) wait(t float64, s *session) bool {
+	for {
+		c.mu.Lock()
+		// a millisecond of tolerance for rounded segment durations
+		reached := t < c.position-0.001
+		done := c.done
+		changed := c.changed
+		c.mu.Unlock()
+
+		if reached {
+			return true
+		}
+		if done {
+			return false
+		}
+
+		select {
+		case <-changed:
+		case <-s.stop:
+			return false
+		}
+	}
+}
+
+// rendition is an audio or subtitle pipeline running next to the main track
+type rendition struct {
+	s        *session
+	clock    *mediaClock
+	alt      *m3u8.Alternative
+	url      *url.URL
+	segments int
+}
+
+func (r *rendition) String() string {
+	name := strings.ToLower(r.alt.Type)
+	if r.alt.Language != "" {
+		name += " " + r.alt.Language
+	}
+	return name
+}
+
+// phase is the phase the segments of r are reported under, audio or subtitles.
+func (r *rendition) phase() string {
+	return strings.ToLower(r.alt.Type)
+}
+
+// mainTrack reports whether phase downloads the main media track, not a rendition.
+func mainTrack(phase string) bool {
+	return phase != "audio" && phase != "subtitles"
+}
+
+func matchLanguage(lang, want string) bool {
+	lang = strings.ToLower(lang)
+	want = strings.ToLower(want)
+	return lang == want || strings.HasPrefix(lang, want+"-")
+}
+
+// selectRendition picks the rendition of kind for the current variant of p.
+func selectRendition(p *player, kind string, group string, sel renditionSelect) *m3u8.Alternative {
+	if sel.lang == renditionNone {
+		return nil
+	}
+	if sel.group != "" {
+		group = sel.group
+	}
+	if group == "" {
+		return nil
+	}
+
+	var candidates []*m3u8.Alternative
+	seen := make(map[*m3u8.Alternative]bool)
+	for _, variant := range p.variants {
+		for _, alt := range variant.Alternatives {
+			// a rendition without URI is muxed into the variant
+			if alt == nil || seen[alt] || alt.Type != kind || alt.GroupId != group || alt.URI == "" {
+				continue
+			}
+			seen[alt] = true
+			candidates = append(candidates, alt)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if sel.lang != "" {
+		for _, alt := range candidates {
+			if matchLanguage(alt.Language, sel.lang) {
+				return alt
+			}
+		}
+		log.Printf("[%d] no %s rendition in %s, using the default", p.n, strings.ToLower(kind), sel.lang)
+	}
+
+	for _, alt := range candidates {
+		if alt.Default {
+			return alt
+		}
+	}
+	return candidates[0]
+}
+
+// startRenditions starts the audio and subtitle pipelines of the current variant of p.
+// the returned function ends them once the main track is done.
+func startRenditions(p *player, u *url.URL, t int, s *session) func() {
+	variant := p.variant()
+	alts := []*m3u8.Alternative{
+		selectRendition(p, "AUDIO", variant.Audio, s.cfg.audio),
+		selectRendition(p, "SUBTITLES", variant.Subtitles, s.cfg.subtitles),
+	}
+
+	var wg sync.WaitGroup
+	var renditions []*rendition
+	for _, alt := range alts {
+		if alt == nil {
+			continue
+		}
+
+		altURL, err := absolutize(alt.URI, u)
+		if err != nil {
+			log.Printf("[%d] error: %s", s.n, err)
+			continue
+		}
+
+		r := &rendition{s: s, clock: s.clock, alt: alt, url: altURL}
+		renditions = append(renditions, r)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.play(t); err != nil {
+				log.Printf("[%d] %s error: %s", s.n, r, err)
+			}
+		}()
+	}
+
+	clock := s.clock
+	return func() {
+		clock.close()
+		wg.Wait()
+		for _, r := range renditions {
+			log.Printf("[%d] %s: %d segments", s.n, r, r.segments)
+		}
+	}
+}
+
+func (r *rendition) play(t int) error {
+	mediapl, err := getMediaPlaylist(r.url, r.s)
+	if err != nil {
+		return err
+	}
+
+	if !mediapl.Closed {
+		return followLive(r.s, t, r.s.cfg.liveDelay, mediapl, r.url, fixedURL(r.url), r, nil)
+	}
+
+	var start float64
+	for idx, segment := range mediapl.Segments {
+		if segment == nil {
+			break
+		}
+		if start+segment.Duration <= r.clock.from {
+			// before the seek position
+			start += segment.Duration
+			continue
+		}
+		if !r.clock.wait(start, r.s) {
+			break
+		}
+
+		_, _, err := downloadSegment(segment, mediapl.SeqNo+uint64(idx), r.url, r.s, 0, r.phase())
+		if err != nil {
+			return err
+		}
+		r.segments++
+		start += segment.Duration
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceRequest is one recorded request of a viewer session
+type traceRequest struct {
+	at  time.Time
+	uri string
+}
+
+// traceSession is the recorded requests of one viewer session in time order
+type traceSession struct {
+	id       string
+	clientIP string
+	requests []traceRequest
+}
+
+func parseTraceTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// parseTrace reads a session trace, one request per line of
+// "timestamp session-id client-ip uri" separated by spaces, tabs or commas.
+// timestamps are unix seconds or RFC3339, lines starting with # are ignored.
+func parseTrace(r io.Reader) ([]*traceSession, error) {
+	sessions := make(map[string]*traceSession)
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		data := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(data) != 4 {
+			return nil, fmt.Errorf("invalid trace line %d : %s", line, text)
+		}
+
+		at, err := parseTraceTime(data[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace timestamp line %d : %s", line, data[0])
+		}
+
+		ts, ok := sessions[data[1]]
+		if !ok {
+			ts = &traceSession{id: data[1], clientIP: data[2]}
+			sessions[data[1]] = ts
+		}
+		ts.requests = append(ts.requests, traceRequest{at: at, uri: data[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var traces []*traceSession
+	for _, ts := range sessions {
+		sort.SliceStable(ts.requests, func(i, j int) bool {
+			return ts.requests[i].at.Before(ts.requests[j].at)
+		})
+		traces = append(traces, ts)
+	}
+	if len(traces) == 0 {
+		return nil, fmt.Errorf("empty trace")
+	}
+
+	sort.Slice(traces, func(i, j int) bool {
+		return traces[i].requests[0].at.Before(traces[j].requests[0].at)
+	})
+	return traces, nil
+}
+
+func readTrace(fileName string) ([]*traceSession, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseTrace(f)
+}
+
+// replayURL points a recorded uri at the test server address.
+func replayURL(uri string, scheme string, address string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = scheme
+	u.Host = address
+	return u, nil
+}
+
+func replayPhase(u *url.URL) string {
+	switch {
+	case strings.HasSuffix(u.Path, ".m3u8") || strings.HasSuffix(u.Path, ".mpd"):
+		return "playlist"
+	case strings.HasSuffix(u.Path, ".key"):
+		return "key"
+	}
+	return "segment"
+}
+
+// replayRequest sends a recorded request, any response below 400 is a success.
+func replayRequest(u *url.URL, s *session) (int64, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	size, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return size, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return size, fmt.Errorf("Received HTTP %v for %v", resp.StatusCode, u.String())
+	}
+	return size, nil
+}
+
+// replaySession sends the requests of ts at their recorded offsets from first,
+// scaled by scale, starting at begin. a request is never sent before the previous one ended.
+func replaySession(s *session, ts *traceSession, first time.Time, begin time.Time, scale float64) {
+	control.track(s)
+	defer control.untrack(s)
+
+	metrics.sessionStarted()
+	defer metrics.sessionEnded(s)
+	defer results.record(s)
+
+	s.kind = "replay"
+	s.info = configInfo{fileName: ts.id, destIP: ts.clientIP}
+
+	client, err := newClient(s, ts.clientIP)
+	if err != nil {
+		s.logError(err)
+		return
+	}
+	s.client = client
+
+	log.Printf("[%d] replay session %s from %s: %d requests", s.n, ts.id, ts.clientIP, len(ts.requests))
+
+	for _, tr := range ts.requests {
+		due := begin.Add(time.Duration(float64(tr.at.Sub(first)) * scale))
+		s.sleep(due.Sub(time.Now()))
+		if s.stopped() {
+			break
+		}
+
+		u, err := replayURL(tr.uri, s.cfg.scheme, s.cfg.address)
+		if err != nil {
+			s.logError(err)
+			continue
+		}
+
+		// how late the replay sends the request, the previous one took too long
+		if lag := time.Now().Sub(due); lag > 0 {
+			stats.observe("replay lag", lag)
+		}
+
+		if s.info.serviceCode == "" {
+			s.info.serviceCode = strings.Split(strings.TrimPrefix(u.Path, "/"), "/")[0]
+		}
+
+		phase := replayPhase(u)
+		start := time.Now()
+		size, err := replayRequest(u, s)
+		elapsed := time.Now().Sub(start)
+		if err != nil {
+			stats.fail(phase)
+			s.fail(phase)
+			if phase == "segment" {
+				s.segmentFailed(size)
+			}
+			s.logError(err)
+			continue
+		}
+
+		stats.observe(phase, elapsed)
+		if phase == "segment" {
+			metrics.segment(s, size, elapsed)
+			s.mu.Lock()
+			s.segments++
+			s.bytes += size
+			s.mu.Unlock()
+		}
+	}
+
+	log.Printf("[%d] replay session %s end", s.n, ts.id)
+}
+
+// runReplay replays every traced session with the recorded timing and waits for them.
+// session i is numbered offset+i*step.
+func runReplay(traces []*traceSession, scale float64, offset int, step int, sc *sessionConfig) {
+	first := traces[0].requests[0].at
+	begin := time.Now()
+
+	wg := new(sync.WaitGroup)
+	for i, ts := range traces {
+		wg.Add(1)
+		go func(n int, ts *traceSession) {
+			defer wg.Done()
+			replaySession(newSession(n, sc), ts, first, begin, scale)
+		}(offset+i*step, ts)
+	}
+	control.wait(wg)
+}
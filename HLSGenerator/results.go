@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// per session result formats
+const (
+	resultJSONL = "jsonl"
+	resultCSV   = "csv"
+)
+
+// sessionResult is the record written for every session at its end
+type sessionResult struct {
+	Session        int     `json:"session"`
+	Start          string  `json:"start"`
+	End            string  `json:"end"`
+	Content        string  `json:"content"`
+	ClientIP       string  `json:"clientIp"`
+	ServiceCode    string  `json:"serviceCode"`
+	ContentType    string  `json:"contentType"`
+	Type           string  `json:"type"`
+	DNSMs          float64 `json:"dnsMs"`
+	TLSHandshakes  int     `json:"tlsHandshakes"`
+	TLSMs          float64 `json:"tlsMs"` // all handshakes of the session
+	GSLBURL        string  `json:"gslbUrl"`
+	GSLBMs         float64 `json:"gslbMs"`
+	GLBURL         string  `json:"glbUrl"`
+	GLBMs          float64 `json:"glbMs"`
+	VODURL         string  `json:"vodUrl"`
+	VODMs          float64 `json:"vodMs"`
+	Segments       int     `json:"segments"`
+	SegmentsFailed int     `json:"segmentsFailed"`
+	Bytes          int64   `json:"bytes"`
+	RateBps        int64   `json:"rateBps"`
+	Connections    int     `json:"connections"`
+	StartupMs      float64 `json:"startupMs"`
+	Stalls         int     `json:"stalls"`
+	StallMs        float64 `json:"stallMs"`
+	Retries        int     `json:"retries"`
+	Failovers      int     `json:"failovers"`
+	FailedPhase    string  `json:"failedPhase"`
+	Error          string  `json:"error"`
+}
+
+var resultHeader = []string{
+	"session", "start", "end", "content", "clientIp", "serviceCode", "contentType", "type",
+	"dnsMs", "tlsHandshakes", "tlsMs", "gslbUrl", "gslbMs", "glbUrl", "glbMs", "vodUrl", "vodMs",
+	"segments", "segmentsFailed", "bytes", "rateBps", "connections", "startupMs", "stalls", "stallMs",
+	"retries", "failovers", "failedPhase", "error",
+}
+
+func (r *sessionResult) row() []string {
+	ms := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return []string{
+		strconv.Itoa(r.Session), r.Start, r.End, r.Content, r.ClientIP, r.ServiceCode, r.ContentType, r.Type,
+		ms(r.DNSMs), strconv.Itoa(r.TLSHandshakes), ms(r.TLSMs), r.GSLBURL, ms(r.GSLBMs), r.GLBURL, ms(r.GLBMs), r.VODURL, ms(r.VODMs),
+		strconv.Itoa(r.Segments), strconv.Itoa(r.SegmentsFailed), strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.RateBps, 10), strconv.Itoa(r.Connections),
+		ms(r.StartupMs), strconv.Itoa(r.Stalls), ms(r.StallMs),
+		strconv.Itoa(r.Retries), strconv.Itoa(r.Failovers), r.FailedPhase, r.Error,
+	}
+}
+
+// durationMs returns d in milliseconds rounded to 0.1 ms.
+func durationMs(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+func newSessionResult(s *session, start, end time.Time) *sessionResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &sessionResult{
+		Session:        s.n,
+		Start:          start.Format(time.RFC3339Nano),
+		End:            end.Format(time.RFC3339Nano),
+		Content:        s.info.fileName,
+		ClientIP:       s.info.destIP,
+		ServiceCode:    s.info.serviceCode,
+		ContentType:    s.info.contentType,
+		Type:           s.kind,
+		DNSMs:          durationMs(s.dnsTime),
+		TLSHandshakes:  s.tlsHandshakes,
+		TLSMs:          durationMs(s.tlsTime),
+		GSLBURL:        s.gslbURL,
+		GSLBMs:         durationMs(s.gslbTime),
+		GLBURL:         s.glbURL,
+		GLBMs:          durationMs(s.glbTime),
+		VODURL:         s.vodURL,
+		VODMs:          durationMs(s.vodTime),
+		Segments:       s.segments,
+		SegmentsFailed: s.segmentErrors,
+		Bytes:          s.bytes,
+		RateBps:        s.rate,
+		Connections:    s.newConns,
+		Retries:        s.retries,
+		Failovers:      s.failovers,
+		FailedPhase:    s.failed,
+		Error:          s.lastError,
+	}
+
+	if s.buffer != nil {
+		r.StartupMs = durationMs(s.buffer.startupDelay())
+		r.Stalls = s.buffer.stalls
+		r.StallMs = durationMs(s.buffer.stallTime)
+	}
+	return r
+}
+
+// resultLog writes one sessionResult per ended session
+type resultLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	format string
+	json   *json.Encoder
+	csv    *csv.Writer
+}
+
+var results = &resultLog{}
+
+// open creates the result file, "-" writes to stdout.
+func (l *resultLog) open(fileName string, format string) error {
+	f := os.Stdout
+	if fileName != "-" {
+		var err error
+		if f, err = os.Create(fileName); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.file = f
+	l.format = format
+	if format == resultCSV {
+		l.csv = csv.NewWriter(f)
+		l.csv.Write(resultHeader)
+		l.csv.Flush()
+		return l.csv.Error()
+	}
+	l.json = json.NewEncoder(f)
+	return nil
+}
+
+// record writes the result of s, it is only counted without a result file.
+func (l *resultLog) record(s *session) {
+	r := newSessionResult(s, s.begin, time.Now())
+	recovery.record(r)
+	l.add(r)
+}
+
+func (l *resultLog) add(r *sessionResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if l.csv != nil {
+		l.csv.Write(r.row())
+		l.csv.Flush()
+		return
+	}
+	l.json.Encode(r)
+}
+
+func (l *resultLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		if l.file != os.Stdout {
+			l.file.Close()
+		}
+		l.file = nil
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phases a retry policy can be set for
+var retryPhases = []string{"gslb", "glb", "vod", "playlist", "key", "init", "segment", "part", "audio", "subtitles"}
+
+// retryPolicy retries a failed request of a phase after an exponential backoff
+type retryPolicy struct {
+	attempts int           // retries after the first request
+	backoff  time.Duration // wait before the first retry, doubled for every further one
+}
+
+// parseRetry parses comma separated phase:retries[:backoff] policies,
+// "all" sets every phase. (ex) all:2,segment:3:500ms
+func parseRetry(text string) (map[string]retryPolicy, error) {
+	policies := make(map[string]retryPolicy)
+	for _, v := range strings.Split(text, ",") {
+		data := strings.Split(strings.TrimSpace(v), ":")
+		if len(data) < 2 || len(data) > 3 {
+			return nil, fmt.Errorf("invalid retry policy : %s", v)
+		}
+
+		attempts, err := strconv.Atoi(data[1])
+		if err != nil || attempts < 0 {
+			return nil, fmt.Errorf("invalid retry count : %s", v)
+		}
+		p := retryPolicy{attempts: attempts, backoff: 200 * time.Millisecond}
+		if len(data) == 3 {
+			if p.backoff, err = time.ParseDuration(data[2]); err != nil || p.backoff < 0 {
+				return nil, fmt.Errorf("invalid retry backoff : %s", v)
+			}
+		}
+
+		switch {
+		case data[0] == "all":
+			for _, phase := range retryPhases {
+				policies[phase] = p
+			}
+		case validRetryPhase(data[0]):
+			policies[data[0]] = p
+		default:
+			return nil, fmt.Errorf("invalid retry phase : %s", data[0])
+		}
+	}
+	return policies, nil
+}
+
+func validRetryPhase(phase string) bool {
+	for _, p := range retryPhases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the backoff before retry number attempt, counted from 1.
+func (p retryPolicy) delay(attempt int, max time.Duration) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && (max <= 0 || d < max); i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// retry calls request until it succeeds or the retries of the phase policy are used up.
+// every failed request counts as an error of the phase, the session fails only with the last one.
+func (s *session) retry(phase string, request func() error) error {
+	p := s.cfg.retry[phase]
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if err == nil {
+			return nil
+		}
+		stats.fail(phase)
+		if attempt >= p.attempts || s.stopped() {
+			return err
+		}
+
+		d := p.delay(attempt+1, s.cfg.retryMaxBackoff)
+		s.mu.Lock()
+		s.retries++
+		s.mu.Unlock()
+		log.Printf("[%d] %s retry %d/%d in %d ms: %s", s.n, phase, attempt+1, p.attempts, int(d)/1000000, err)
+
+		s.sleep(d)
+		if s.stopped() {
+			return err
+		}
+	}
+}
+
+// failover moves the session to the next gslb candidate after err.
+func (s *session) failover(phase string, next string, err error) {
+	s.mu.Lock()
+	s.failovers++
+	s.mu.Unlock()
+	log.Printf("[%d] %s failed, failover to %s: %s", s.n, phase, next, err)
+}
+
+// recoveryStats counts the sessions that needed retries or a failover
+type recoveryStats struct {
+	mu                 sync.Mutex
+	sessions           int
+	retriedSessions    int
+	retries            int
+	failedOverSessions int
+	failovers          int
+}
+
+var recovery = &recoveryStats{}
+
+func (r *recoveryStats) record(res *sessionResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions++
+	if res.Retries > 0 {
+		r.retriedSessions++
+		r.retries += res.Retries
+	}
+	if res.Failovers > 0 {
+		r.failedOverSessions++
+		r.failovers += res.Failovers
+	}
+}
+
+func (r *recoveryStats) print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Printf("recovery: %d of %d sessions retried (%d retries), %d failed over (%d failovers)",
+		r.retriedSessions, r.sessions, r.retries, r.failedOverSessions, r.failovers)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scenarioEntry is one entry of a yaml or json generation info file.
+// unset fields take the defaults of the file, then the command line flags.
+type scenarioEntry struct {
+	Content        string  `yaml:"content"`
+	ClientIP       string  `yaml:"clientIP"` // address, CIDR or range pool
+	ServiceCode    string  `yaml:"serviceCode"`
+	ContentType    string  `yaml:"contentType"`
+	Bitrate        string  `yaml:"bitrate"`
+	Weight         float64 `yaml:"weight"`
+	Playtime       string  `yaml:"playtime"` // seconds or a min-max range
+	Type           string  `yaml:"type"`     // adaptive or static
+	GSLB           *bool   `yaml:"gslb"`
+	Behavior       string  `yaml:"behavior"`
+	BehaviorRandom string  `yaml:"behaviorRandom"`
+}
+
+// scenarioFile is a generation info file with per entry settings, e.g.
+//
+//	defaults: {serviceCode: OTM, contentType: live, bitrate: H, clientIP: 10.1.0.0/24}
+//	entries:
+//	  - {content: "34500", weight: 5, playtime: 300-900, type: adaptive}
+//	  - {content: movie.mpg, serviceCode: SKYLIFE, contentType: vod, gslb: false}
+type scenarioFile struct {
+	Defaults scenarioEntry   `yaml:"defaults"`
+	Entries  []scenarioEntry `yaml:"entries"`
+}
+
+// isScenario tells a yaml or json scenario from the five column text file.
+// agents get the file content without its name, so the content decides.
+func isScenario(data []byte) bool {
+	text := bytes.TrimSpace(data)
+	if bytes.HasPrefix(text, []byte("{")) || bytes.HasPrefix(text, []byte("---")) {
+		return true
+	}
+	for _, line := range strings.Split(string(text), "\n") {
+		if strings.HasPrefix(line, "entries:") || strings.HasPrefix(line, "defaults:") {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlaytime parses seconds or a min-max range of seconds.
+func parsePlaytime(v string) (int, int, error) {
+	data := strings.SplitN(v, "-", 2)
+	min, err := strconv.Atoi(strings.TrimSpace(data[0]))
+	if err != nil || min <= 0 {
+		return 0, 0, fmt.Errorf("invalid playtime : %s", v)
+	}
+	max := min
+	if len(data) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(data[1])); err != nil || max < min {
+			return 0, 0, fmt.Errorf("invalid playtime : %s", v)
+		}
+	}
+	return min, max, nil
+}
+
+// merge fills the unset fields of e from defaults.
+func (e scenarioEntry) merge(defaults scenarioEntry) scenarioEntry {
+	for _, f := range []struct{ v, d *string }{
+		{&e.ClientIP, &defaults.ClientIP},
+		{&e.ServiceCode, &defaults.ServiceCode},
+		{&e.ContentType, &defaults.ContentType},
+		{&e.Bitrate, &defaults.Bitrate},
+		{&e.Playtime, &defaults.Playtime},
+		{&e.Type, &defaults.Type},
+		{&e.Behavior, &defaults.Behavior},
+		{&e.BehaviorRandom, &defaults.BehaviorRandom},
+	} {
+		if *f.v == "" {
+			*f.v = *f.d
+		}
+	}
+	if e.Weight == 0 {
+		e.Weight = defaults.Weight
+	}
+	if e.GSLB == nil {
+		e.GSLB = defaults.GSLB
+	}
+	return e
+}
+
+// configInfo converts e, pools are shared by the entries with the same ClientIP text.
+func (e scenarioEntry) configInfo(pools map[string]*ipPool, alloc string) (configInfo, error) {
+	cfg := configInfo{
+		fileName:      e.Content,
+		destIP:        e.ClientIP,
+		serviceCode:   e.ServiceCode,
+		contentType:   e.ContentType,
+		bitrateType:   e.Bitrate,
+		weight:        e.Weight,
+		streamingType: e.Type,
+		gslb:          e.GSLB,
+	}
+
+	for _, f := range []struct{ name, v string }{
+		{"content", e.Content},
+		{"clientIP", e.ClientIP},
+		{"serviceCode", e.ServiceCode},
+		{"contentType", e.ContentType},
+		{"bitrate", e.Bitrate},
+	} {
+		if f.v == "" {
+			return cfg, fmt.Errorf("missing %s", f.name)
+		}
+	}
+	if e.Weight < 0 {
+		return cfg, fmt.Errorf("invalid weight : %g", e.Weight)
+	}
+	if e.Type != "" && e.Type != "adaptive" && e.Type != "static" {
+		return cfg, fmt.Errorf("invalid type : %s", e.Type)
+	}
+
+	var err error
+	if e.Playtime != "" {
+		if cfg.playMin, cfg.playMax, err = parsePlaytime(e.Playtime); err != nil {
+			return cfg, err
+		}
+	}
+
+	if e.Behavior != "" || e.BehaviorRandom != "" {
+		cfg.behavior = &behaviorConfig{}
+		if e.Behavior != "" {
+			if cfg.behavior.script, err = parseScript(e.Behavior); err != nil {
+				return cfg, err
+			}
+		}
+		if e.BehaviorRandom != "" {
+			if cfg.behavior.random, err = parseRandomBehavior(e.BehaviorRandom); err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	if cfg.pool, err = entryPool(pools, cfg.destIP, alloc); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// parseScenario parses a yaml or json scenario. entries without a weight
+// weigh 1 once any entry has one, without weights sessions take the entries in turn.
+func parseScenario(data []byte, alloc string) ([]configInfo, error) {
+	var sf scenarioFile
+	if err := yaml.Unmarshal(data, &sf); err != nil {
+		return nil, err
+	}
+
+	var cfglist []configInfo
+	weighted := false
+	pools := make(map[string]*ipPool)
+	for idx, e := range sf.Entries {
+		cfg, err := e.merge(sf.Defaults).configInfo(pools, alloc)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d (%s): %s", idx+1, e.Content, err)
+		}
+		if cfg.weight > 0 {
+			weighted = true
+		}
+		cfglist = append(cfglist, cfg)
+	}
+
+	if weighted {
+		for idx := range cfglist {
+			if cfglist[idx].weight == 0 {
+				cfglist[idx].weight = 1
+			}
+		}
+	}
+	return cfglist, nil
+}
+
+// pickWeighted draws one of entries by weight, evenly when none has a weight.
+func pickWeighted(entries []configInfo, rnd *rand.Rand) configInfo {
+	var total float64
+	for _, entry := range entries {
+		total += entry.weight
+	}
+	if total <= 0 {
+		return entries[rnd.Intn(len(entries))]
+	}
+
+	x := rnd.Float64() * total
+	for _, entry := range entries {
+		if x < entry.weight {
+			return entry
+		}
+		x -= entry.weight
+	}
+	return entries[len(entries)-1]
+}
+
+// playtime returns the seconds to play cfg, t unless the entry has its own range.
+func (cfg configInfo) playtime(t int, rnd *rand.Rand) int {
+	if cfg.playMax == 0 {
+		return t
+	}
+	return cfg.playMin + rnd.Intn(cfg.playMax-cfg.playMin+1)
+}
+
+// streamingType is the streaming type sent to gslb for the entry played.
+func (s *session) streamingType() string {
+	if s.info.streamingType != "" {
+		return s.info.streamingType
+	}
+	return s.cfg.streamingType
+}
+
+// useGSLB reports whether the entry played is set up through gslb.
+func (s *session) useGSLB() bool {
+	if s.info.gslb != nil {
+		return *s.info.gslb
+	}
+	return s.cfg.useGSLB
+}
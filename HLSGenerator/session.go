@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionConfig holds the run wide settings every session starts from
+type sessionConfig struct {
+	address          string
+	streamingType    string
+	protocol         string // hls or dash
+	useGSLB          bool
+	disableKeepAlive bool
+	validate         bool
+	decrypt          bool
+	liveDelay        int
+	bufferTarget     float64 // seconds kept buffered, 0 paces by segment duration
+	bufferStartup    float64 // seconds buffered before playback starts
+	abr              *abrConfig
+	audio            renditionSelect
+	subtitles        renditionSelect
+	behavior         *behaviorConfig // nil plays linearly
+	entries          []configInfo    // generation info entries to zap between
+	scheme           string          // glb and content scheme without gslb
+	gslbScheme       string
+	gslbClient       *http.Client
+	tls              *tls.Config
+	http2            bool
+	ipPool           *ipPool // replaces the ClientIP column of every entry
+	retry            map[string]retryPolicy
+	retryMaxBackoff  time.Duration
+	failover         bool        // try the further gslb one time urls when glb or vod fail
+	rates            []rateClass // download rate caps sessions are drawn from
+	resolver         *hostResolver
+	lowLatency       bool // play live playlists with EXT-X-PART-INF by parts
+}
+
+// session holds the per-session state shared by the playback functions
+type session struct {
+	n      int
+	begin  time.Time
+	cfg    *sessionConfig
+	info   configInfo
+	client *http.Client
+	keys   map[string][]byte   // key URI -> key
+	inits  map[string]bool     // init section URI and range already fetched
+	hosts  map[string][]string // host -> addresses resolved by the session
+	buffer *playbackBuffer
+	clock  *mediaClock
+	viewer *viewer
+	stop   chan struct{}
+	zap    bool // the viewer left the current entry for another one
+	pool   *ipPool
+	ip     string // local bind address allocated from pool
+
+	rate    int64        // download cap in bits per second, 0 is unlimited
+	limiter *rateLimiter // shared by all connections of the session, nil without cap
+
+	// setup of the last entry played and the kind of session it was
+	kind     string
+	gslbURL  string
+	glbURL   string
+	vodURL   string
+	gslbTime time.Duration
+	glbTime  time.Duration
+	vodTime  time.Duration
+
+	// guards the fields below and keys, inits and hosts, rendition pipelines share the session
+	mu            sync.Mutex
+	failed        string // phase of the error that ended the session
+	segments      int
+	segmentErrors int
+	bytes         int64
+	lastError     string
+	corrupt       int
+	decryptFailed int
+	dnsLookups    int
+	dnsTime       time.Duration
+	newConns      int // requests that opened a connection
+	reusedConns   int // requests on a kept alive connection
+	tlsHandshakes int
+	tlsTime       time.Duration
+	retries       int
+	failovers     int
+}
+
+func newSession(n int, cfg *sessionConfig) *session {
+	s := &session{
+		n:      n,
+		begin:  time.Now(),
+		cfg:    cfg,
+		keys:   make(map[string][]byte),
+		inits:  make(map[string]bool),
+		hosts:  make(map[string][]string),
+		clock:  newMediaClock(0),
+		viewer: newViewer(cfg.behavior, n),
+		stop:   make(chan struct{}),
+	}
+
+	if s.rate = pickRate(cfg.rates, n); s.rate > 0 {
+		s.limiter = &rateLimiter{rate: s.rate}
+	}
+	return s
+}
+
+// fail records the phase of the first error of the session.
+func (s *session) fail(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed == "" {
+		s.failed = phase
+	}
+}
+
+// stopped reports whether the session was asked to end after the current segment.
+func (s *session) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// segmentFailed counts a failed segment download of which size bytes were received.
+func (s *session) segmentFailed(size int64) {
+	s.mu.Lock()
+	s.segmentErrors++
+	s.bytes += size
+	s.mu.Unlock()
+}
+
+// logError logs err and keeps it as the last error of the session.
+func (s *session) logError(err error) {
+	s.mu.Lock()
+	s.lastError = err.Error()
+	s.mu.Unlock()
+
+	log.Printf("[%d] error: %s", s.n, err)
+}
+
+// end asks the session to stop after the current segment.
+func (s *session) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopped() {
+		close(s.stop)
+	}
+}
+
+// sleep waits for d or until the session is stopped.
+func (s *session) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.stop:
+	}
+}
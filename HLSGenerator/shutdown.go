@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runControl tracks the running sessions so a signal can end the run gracefully
+type runControl struct {
+	mu       sync.Mutex
+	active   map[*session]bool
+	stopping chan struct{}
+	grace    time.Duration
+}
+
+var control = &runControl{
+	active:   make(map[*session]bool),
+	stopping: make(chan struct{}),
+}
+
+// track registers a started session, it is ended right away during a shutdown.
+func (c *runControl) track(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active[s] = true
+	if c.stopped() {
+		s.end()
+	}
+}
+
+func (c *runControl) untrack(s *session) {
+	c.mu.Lock()
+	delete(c.active, s)
+	c.mu.Unlock()
+}
+
+// stopped reports whether a shutdown was requested, no new session should start.
+func (c *runControl) stopped() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop ends every running session after its current segment.
+func (c *runControl) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped() {
+		return
+	}
+	close(c.stopping)
+	for s := range c.active {
+		s.end()
+	}
+}
+
+func (c *runControl) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.active)
+}
+
+// sleep waits for d or until a shutdown is requested.
+func (c *runControl) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.stopping:
+	}
+}
+
+// wait waits for wg, after a shutdown request at most for the grace period.
+func (c *runControl) wait(wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-c.stopping:
+	}
+
+	select {
+	case <-done:
+	case <-time.After(c.grace):
+		log.Printf("grace period over, %d sessions still running", c.count())
+	}
+}
+
+// handleSignals starts a graceful shutdown on SIGINT or SIGTERM, a second signal exits at once.
+func handleSignals(grace time.Duration) {
+	control.grace = grace
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("%v: stopping %d sessions, grace period %v", sig, control.count(), grace)
+		control.stop()
+
+		sig = <-signals
+		log.Printf("%v: exit", sig)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// histogram buckets grow by histogramGrowth from histogramResolution, about 1% precision
+// at any latency. anything below histogramResolution lands in the first bucket, above histogramMax in the last
+const (
+	histogramResolution = 100 * time.Microsecond
+	histogramMax        = 60 * time.Second
+	histogramGrowth     = 1.01
+)
+
+var histogramBuckets = bucketIndex(histogramMax) + 1
+
+// bucketIndex returns the bucket of d, bucket idx holds the latencies up to bucketBound(idx).
+func bucketIndex(d time.Duration) int {
+	if d <= histogramResolution {
+		return 0
+	}
+	return int(math.Ceil(math.Log(float64(d)/float64(histogramResolution)) / math.Log(histogramGrowth)))
+}
+
+func bucketBound(idx int) time.Duration {
+	return time.Duration(float64(histogramResolution) * math.Pow(histogramGrowth, float64(idx)))
+}
+
+type histogram struct {
+	buckets []int64
+	count   int64
+	errors  int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]int64, histogramBuckets)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	idx := bucketIndex(d)
+	if idx >= len(h.buckets) {
+		idx = len(h.buckets) - 1
+	}
+	h.buckets[idx]++
+
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(p/100*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for idx, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			d := bucketBound(idx)
+			if d > h.max {
+				return h.max
+			}
+			if d < h.min {
+				return h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+type phaseReport struct {
+	Phase  string  `json:"phase"`
+	Count  int64   `json:"count"`
+	Errors int64   `json:"errors"`
+	Min    float64 `json:"minMs"`
+	Max    float64 `json:"maxMs"`
+	Mean   float64 `json:"meanMs"`
+	P50    float64 `json:"p50Ms"`
+	P90    float64 `json:"p90Ms"`
+	P99    float64 `json:"p99Ms"`
+}
+
+type runStats struct {
+	mu     sync.Mutex
+	phases map[string]*histogram
+}
+
+var stats = &runStats{phases: make(map[string]*histogram)}
+
+// phases are reported in this order, unknown phases are appended alphabetically
+var phaseOrder = []string{"dns", "tls", "gslb", "glb", "vod", "playlist", "blocking reload", "key", "init", "segment", "part", "part edge", "audio", "subtitles", "startup", "rebuffer", "seek", "zap"}
+
+func (s *runStats) phase(name string) *histogram {
+	h, ok := s.phases[name]
+	if !ok {
+		h = newHistogram()
+		s.phases[name] = h
+	}
+	return h
+}
+
+func (s *runStats) observe(name string, d time.Duration) {
+	s.mu.Lock()
+	s.phase(name).observe(d)
+	s.mu.Unlock()
+}
+
+func (s *runStats) fail(name string) {
+	s.mu.Lock()
+	s.phase(name).errors++
+	s.mu.Unlock()
+}
+
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (s *runStats) report() []phaseReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	known := make(map[string]bool)
+	for _, name := range phaseOrder {
+		known[name] = true
+		if _, ok := s.phases[name]; ok {
+			names = append(names, name)
+		}
+	}
+	var extra []string
+	for name := range s.phases {
+		if !known[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	names = append(names, extra...)
+
+	var reports []phaseReport
+	for _, name := range names {
+		h := s.phases[name]
+		r := phaseReport{Phase: name, Count: h.count, Errors: h.errors}
+		if h.count > 0 {
+			r.Min = msec(h.min)
+			r.Max = msec(h.max)
+			r.Mean = msec(h.sum) / float64(h.count)
+			r.P50 = msec(h.percentile(50))
+			r.P90 = msec(h.percentile(90))
+			r.P99 = msec(h.percentile(99))
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// histogramDump is a histogram as agents send it to the coordinator, buckets are sparse
+type histogramDump struct {
+	Buckets map[int]int64 `json:"buckets"`
+	Count   int64         `json:"count"`
+	Errors  int64         `json:"errors"`
+	Sum     time.Duration `json:"sum"`
+	Min     time.Duration `json:"min"`
+	Max     time.Duration `json:"max"`
+}
+
+func (s *runStats) dump() map[string]histogramDump {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phases := make(map[string]histogramDump)
+	for name, h := range s.phases {
+		d := histogramDump{Buckets: make(map[int]int64), Count: h.count, Errors: h.errors, Sum: h.sum, Min: h.min, Max: h.max}
+		for idx, n := range h.buckets {
+			if n > 0 {
+				d.Buckets[idx] = n
+			}
+		}
+		phases[name] = d
+	}
+	return phases
+}
+
+// merge adds the histograms of another process to s.
+func (s *runStats) merge(phases map[string]histogramDump) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, d := range phases {
+		h := s.phase(name)
+		for idx, n := range d.Buckets {
+			if idx >= 0 && idx < len(h.buckets) {
+				h.buckets[idx] += n
+			}
+		}
+		if d.Count > 0 {
+			if h.count == 0 || d.Min < h.min {
+				h.min = d.Min
+			}
+			if d.Max > h.max {
+				h.max = d.Max
+			}
+		}
+		h.count += d.Count
+		h.errors += d.Errors
+		h.sum += d.Sum
+	}
+}
+
+func printReport(reports []phaseReport) {
+	// long phases like "blocking reload" widen the phase column
+	width := 10
+	for _, r := range reports {
+		if len(r.Phase) > width {
+			width = len(r.Phase)
+		}
+	}
+
+	log.Println("latency summary (ms)")
+	log.Printf("%-*s %8s %8s %10s %10s %10s %10s %10s %10s", width, "phase", "count", "errors", "min", "max", "mean", "p50", "p90", "p99")
+	for _, r := range reports {
+		log.Printf("%-*s %8d %8d %10.1f %10.1f %10.1f %10.1f %10.1f %10.1f", width, r.Phase, r.Count, r.Errors, r.Min, r.Max, r.Mean, r.P50, r.P90, r.P99)
+	}
+}
+
+func writeReport(fileName string, reports []phaseReport) error {
+	doc, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(fileName, doc, 0644); err != nil {
+		return fmt.Errorf("report write %s: %s", fileName, err)
+	}
+	return nil
+}
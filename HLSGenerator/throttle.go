@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateClass is the download rate cap of a share of the sessions
+type rateClass struct {
+	percent float64
+	rate    int64 // bits per second, 0 is unlimited
+}
+
+// parseRate parses a rate in bits per second with an optional k, M or G suffix, unlimited is 0.
+func parseRate(v string) (int64, error) {
+	v = strings.TrimSuffix(strings.TrimSpace(v), "bps")
+	if v == "unlimited" || v == "0" {
+		return 0, nil
+	}
+
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(v, "k"), strings.HasSuffix(v, "K"):
+		unit = 1e3
+	case strings.HasSuffix(v, "M"):
+		unit = 1e6
+	case strings.HasSuffix(v, "G"):
+		unit = 1e9
+	}
+	if unit > 1 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate : %s", v)
+	}
+	return int64(n * unit), nil
+}
+
+// parseRates parses a fixed rate (3M) or comma separated shares of sessions
+// that add up to 100%. (ex) 30%:3M,50%:8M,20%:unlimited
+func parseRates(text string) ([]rateClass, error) {
+	if !strings.Contains(text, "%") {
+		rate, err := parseRate(text)
+		if err != nil {
+			return nil, err
+		}
+		return []rateClass{{percent: 100, rate: rate}}, nil
+	}
+
+	var classes []rateClass
+	var total float64
+	for _, v := range strings.Split(text, ",") {
+		data := strings.SplitN(strings.TrimSpace(v), "%:", 2)
+		if len(data) != 2 {
+			return nil, fmt.Errorf("invalid rate share : %s", v)
+		}
+
+		percent, err := strconv.ParseFloat(data[0], 64)
+		if err != nil || percent <= 0 {
+			return nil, fmt.Errorf("invalid rate share : %s", v)
+		}
+		rate, err := parseRate(data[1])
+		if err != nil {
+			return nil, err
+		}
+
+		classes = append(classes, rateClass{percent: percent, rate: rate})
+		total += percent
+	}
+	if total < 99.999 || total > 100.001 {
+		return nil, fmt.Errorf("rate shares add up to %g%%, not 100%%", total)
+	}
+	return classes, nil
+}
+
+// pickRate draws the rate cap of session n from classes.
+func pickRate(classes []rateClass, n int) int64 {
+	if len(classes) == 0 {
+		return 0
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(n)))
+	x := rnd.Float64() * 100
+	for _, c := range classes {
+		if x < c.percent {
+			return c.rate
+		}
+		x -= c.percent
+	}
+	return classes[len(classes)-1].rate
+}
+
+func formatRate(rate int64) string {
+	switch {
+	case rate == 0:
+		return "unlimited"
+	case rate >= 1e6:
+		return strconv.FormatFloat(float64(rate)/1e6, 'g', -1, 64) + " Mbps"
+	case rate >= 1e3:
+		return strconv.FormatFloat(float64(rate)/1e3, 'g', -1, 64) + " kbps"
+	}
+	return strconv.FormatInt(rate, 10) + " bps"
+}
+
+// rateLimiter spreads the reads of all connections of a session to rate bits per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // when the bytes read so far are paid for
+}
+
+// wait blocks until n more bytes fit the rate.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * 8 * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// chunk is the largest read, about 50 ms worth of data so the reads stay smooth.
+func (l *rateLimiter) chunk() int {
+	n := int(l.rate / 8 / 20)
+	if n < 1024 {
+		n = 1024
+	}
+	return n
+}
+
+// throttledConn reads no faster than its limiter allows, the server sees a slow reader
+type throttledConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if max := c.limiter.chunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
+
+// throttledDial dials with dial and caps the connection to the session rate.
+func throttledDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), s *session) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil || s.limiter == nil {
+			return conn, err
+		}
+		return &throttledConn{Conn: conn, limiter: s.limiter}, nil
+	}
+}
+
+// requestTimeout bounds a whole request of an uncapped session,
+// only the wait for the response headers of a capped one.
+const requestTimeout = 5 * time.Second
+
+// headerTimeoutTransport fails requests whose response headers take longer than timeout.
+// a capped session reads slowly on purpose, so its bodies have no deadline.
+type headerTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("timeout awaiting response headers for %s", req.URL)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of its request when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
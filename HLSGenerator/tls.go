@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptrace"
+	"time"
+)
+
+// loadTLSConfig builds the client TLS settings shared by every session.
+// caFile replaces the system roots, certFile and keyFile add a client certificate.
+func loadTLSConfig(caFile, certFile, keyFile string, insecure bool, http2 bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: insecure,
+		NextProtos:         []string{"http/1.1"},
+	}
+	if http2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// tlsDial returns a DialTLSContext that times the handshake of every connection.
+// the handshakes are counted for s, which may be nil.
+func tlsDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), cfg *tls.Config, s *session) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		config := cfg.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+
+		// the transport only reports the handshakes it does itself
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+
+		start := time.Now()
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+		}
+		if err != nil {
+			conn.Close()
+			stats.fail("tls")
+			if s != nil {
+				s.fail("tls")
+			}
+			return nil, err
+		}
+
+		elapsed := time.Now().Sub(start)
+		stats.observe("tls", elapsed)
+		if s != nil {
+			s.mu.Lock()
+			s.tlsHandshakes++
+			s.tlsTime += elapsed
+			s.mu.Unlock()
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+type phaseKey struct{}
+
+// withPhase tags req with the phase its timing breakdown is reported under.
+func withPhase(req *http.Request, phase string) *http.Request {
+	if phase == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), phaseKey{}, phase))
+}
+
+// requestPhase returns the tagged phase of req, else the phase its path suggests.
+func requestPhase(req *http.Request) string {
+	if phase, ok := req.Context().Value(phaseKey{}).(string); ok {
+		return phase
+	}
+	return replayPhase(req.URL)
+}
+
+// requestTrace is the timing of one request from the httptrace hooks
+type requestTrace struct {
+	phase string
+	host  string
+	start time.Time
+
+	reused    bool
+	dns       time.Duration
+	connect   time.Duration
+	tls       time.Duration
+	firstByte time.Duration // ttfb from the request start
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+
+	mu   sync.Mutex
+	once sync.Once
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	// dial hooks run on the dial goroutine, it may outlive the request
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			if !t.dnsStart.IsZero() {
+				t.dns = time.Now().Sub(t.dnsStart)
+			}
+			t.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			if err == nil && t.connect == 0 {
+				t.connect = time.Now().Sub(t.connectStart)
+			}
+			t.mu.Unlock()
+		},
+		// tlsDial reports its handshake, the transport reports it again once it is done
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			if t.tlsStart.IsZero() {
+				t.tlsStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			if t.tls == 0 {
+				t.tls = time.Now().Sub(t.tlsStart)
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now().Sub(t.start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// finish records the request once its body is read or closed.
+func (t *requestTrace) finish(s *session, failed bool) {
+	t.once.Do(func() {
+		requestTimings.record(t, time.Now().Sub(t.start), failed)
+		if s != nil {
+			t.mu.Lock()
+			reused := t.reused
+			t.mu.Unlock()
+
+			s.mu.Lock()
+			if reused {
+				s.reusedConns++
+			} else {
+				s.newConns++
+			}
+			s.mu.Unlock()
+		}
+	})
+}
+
+// tracedBody finishes the trace of its request at the end of the transfer
+type tracedBody struct {
+	io.ReadCloser
+	trace *requestTrace
+	s     *session
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.trace.finish(b.s, err != io.EOF)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.trace.finish(b.s, false)
+	return b.ReadCloser.Close()
+}
+
+// tracingTransport breaks every request of a session down into dns, connect, tls, ttfb and transfer
+type tracingTransport struct {
+	base http.RoundTripper
+	s    *session
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := &requestTrace{phase: requestPhase(req), host: req.URL.Host, start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), tr.clientTrace()))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		tr.finish(t.s, true)
+		return nil, err
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, trace: tr, s: t.s}
+	return resp, nil
+}
+
+// timingSum is the count, sum and maximum of one part of the requests
+type timingSum struct {
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	Max   time.Duration `json:"max"`
+}
+
+func (t *timingSum) add(d time.Duration) {
+	t.Count++
+	t.Sum += d
+	if d > t.Max {
+		t.Max = d
+	}
+}
+
+func (t *timingSum) merge(o timingSum) {
+	t.Count += o.Count
+	t.Sum += o.Sum
+	if o.Max > t.Max {
+		t.Max = o.Max
+	}
+}
+
+func (t timingSum) mean() float64 {
+	if t.Count == 0 {
+		return 0
+	}
+	return msec(t.Sum) / float64(t.Count)
+}
+
+// requestTiming aggregates the requests of one phase to one host.
+// dns, connect and tls only count the requests that opened a connection.
+type requestTiming struct {
+	Phase    string    `json:"phase"`
+	Host     string    `json:"host"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	Reused   int64     `json:"reused"`
+	DNS      timingSum `json:"dns"`
+	Connect  timingSum `json:"connect"`
+	TLS      timingSum `json:"tls"`
+	TTFB     timingSum `json:"ttfb"`
+	Transfer timingSum `json:"transfer"` // first byte to the end of the body
+	Total    timingSum `json:"total"`
+}
+
+type timingKey struct {
+	phase string
+	host  string
+}
+
+type requestTimingStats struct {
+	mu      sync.Mutex
+	timings map[timingKey]*requestTiming
+}
+
+var requestTimings = &requestTimingStats{timings: make(map[timingKey]*requestTiming)}
+
+func (r *requestTimingStats) timing(phase, host string) *requestTiming {
+	key := timingKey{phase, host}
+	t, ok := r.timings[key]
+	if !ok {
+		t = &requestTiming{Phase: phase, Host: host}
+		r.timings[key] = t
+	}
+	return t
+}
+
+func (r *requestTimingStats) record(tr *requestTrace, total time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	t := r.timing(tr.phase, tr.host)
+	t.Requests++
+	if failed {
+		t.Errors++
+		return
+	}
+	if tr.reused {
+		t.Reused++
+	}
+	if tr.dns > 0 {
+		t.DNS.add(tr.dns)
+	}
+	if !tr.reused && tr.connect > 0 {
+		t.Connect.add(tr.connect)
+	}
+	if tr.tls > 0 {
+		t.TLS.add(tr.tls)
+	}
+	if tr.firstByte > 0 {
+		t.TTFB.add(tr.firstByte)
+		t.Transfer.add(total - tr.firstByte)
+	}
+	t.Total.add(total)
+}
+
+// lookup records a dns lookup of host as a request of the dns phase.
+func (r *requestTimingStats) lookup(host string, elapsed time.Duration, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.timing("dns", host)
+	t.Requests++
+	if failed {
+		t.Errors++
+		return
+	}
+	t.DNS.add(elapsed)
+	t.Total.add(elapsed)
+}
+
+func (r *requestTimingStats) dump() []requestTiming {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var timings []requestTiming
+	for _, t := range r.timings {
+		timings = append(timings, *t)
+	}
+	return timings
+}
+
+// merge adds the timings of another process to r.
+func (r *requestTimingStats) merge(timings []requestTiming) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, o := range timings {
+		t := r.timing(o.Phase, o.Host)
+		t.Requests += o.Requests
+		t.Errors += o.Errors
+		t.Reused += o.Reused
+		t.DNS.merge(o.DNS)
+		t.Connect.merge(o.Connect)
+		t.TLS.merge(o.TLS)
+		t.TTFB.merge(o.TTFB)
+		t.Transfer.merge(o.Transfer)
+		t.Total.merge(o.Total)
+	}
+}
+
+func (r *requestTimingStats) print() {
+	timings := r.dump()
+	if len(timings) == 0 {
+		return
+	}
+
+	order := make(map[string]int)
+	for idx, phase := range phaseOrder {
+		order[phase] = idx + 1
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		a, b := timings[i], timings[j]
+		if a.Phase != b.Phase {
+			if order[a.Phase] != order[b.Phase] {
+				return order[a.Phase] < order[b.Phase]
+			}
+			return a.Phase < b.Phase
+		}
+		return a.Host < b.Host
+	})
+
+	width := 8
+	for _, t := range timings {
+		if len(t.Phase) > width {
+			width = len(t.Phase)
+		}
+	}
+
+	log.Println("request breakdown (mean ms, new connections for dns, connect and tls)")
+	log.Printf("%-*s %-24s %8s %6s %7s %8s %8s %8s %8s %9s %8s %8s", width, "phase", "host", "requests", "errors", "reused", "dns", "connect", "tls", "ttfb", "transfer", "total", "max")
+	for _, t := range timings {
+		reused := 0.0
+		if ok := t.Requests - t.Errors; ok > 0 {
+			reused = float64(t.Reused) / float64(ok) * 100
+		}
+		log.Printf("%-*s %-24s %8d %6d %6.1f%% %8.1f %8.1f %8.1f %8.1f %9.1f %8.1f %8.1f", width, t.Phase, t.Host, t.Requests, t.Errors, reused,
+			t.DNS.mean(), t.Connect.mean(), t.TLS.mean(), t.TTFB.mean(), t.Transfer.mean(), t.Total.mean(), msec(t.Total.Max))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+const tsPacketSize = 188
+
+// segment payload formats recognized by the validator
+const (
+	formatUnknown = iota
+	formatTS
+	formatMP4
+	formatOther // packed audio, subtitles: size check only
+	formatInvalid
+)
+
+var mp4BoxTypes = map[string]bool{
+	"ftyp": true, "styp": true, "sidx": true, "moov": true, "moof": true,
+	"mdat": true, "emsg": true, "prft": true, "free": true, "skip": true,
+	"uuid": true, "ssix": true, "mfra": true, "pdin": true, "meta": true,
+}
+
+// segmentValidator checks a segment payload while it is being read.
+type segmentValidator struct {
+	format int
+	head   []byte
+	size   int64
+	err    error
+
+	// fMP4 box walk
+	boxEnd  int64 // offset where the current box ends, -1 if unbounded
+	boxHead []byte
+}
+
+func newSegmentValidator() *segmentValidator {
+	return &segmentValidator{}
+}
+
+func (v *segmentValidator) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if v.format == formatUnknown {
+		// wait for enough bytes to tell the container format
+		v.head = append(v.head, p...)
+		if len(v.head) < 8 {
+			return n, nil
+		}
+		v.format = detectFormat(v.head)
+		if v.format == formatInvalid {
+			v.err = fmt.Errorf("unrecognized segment format % x", v.head[:8])
+		}
+		p, v.head = v.head, nil
+	}
+
+	if v.err == nil {
+		switch v.format {
+		case formatTS:
+			v.checkTS(p)
+		case formatMP4:
+			v.checkMP4(p)
+		}
+	}
+	v.size += int64(len(p))
+
+	return n, nil
+}
+
+func detectFormat(head []byte) int {
+	switch {
+	case head[0] == 0x47:
+		return formatTS
+	case mp4BoxTypes[string(head[4:8])]:
+		return formatMP4
+	case bytes.HasPrefix(head, []byte("ID3")),
+		bytes.HasPrefix(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), []byte("WEBVTT")):
+		return formatOther
+	}
+	return formatInvalid
+}
+
+func (v *segmentValidator) checkTS(p []byte) {
+	// offset of the first sync byte inside p
+	off := (tsPacketSize - int(v.size%tsPacketSize)) % tsPacketSize
+	for i := off; i < len(p); i += tsPacketSize {
+		if p[i] != 0x47 {
+			v.err = fmt.Errorf("missing ts sync byte at offset %d", v.size+int64(i))
+			return
+		}
+	}
+}
+
+func (v *segmentValidator) checkMP4(p []byte) {
+	pos := v.size
+	end := v.size + int64(len(p))
+
+	for pos < end {
+		if v.boxEnd < 0 {
+			// last box runs to the end of the segment
+			return
+		}
+
+		if pos < v.boxEnd {
+			pos = v.boxEnd
+			continue
+		}
+
+		// collect the box header, which may span reads
+		v.boxHead = append(v.boxHead, p[pos-v.size])
+		pos++
+		if len(v.boxHead) < 8 || (len(v.boxHead) < 16 && boxSize32(v.boxHead) == 1) {
+			continue
+		}
+
+		boxStart := pos - int64(len(v.boxHead))
+		boxType := v.boxHead[4:8]
+		for _, b := range boxType {
+			if b < 0x20 || b > 0x7e {
+				v.err = fmt.Errorf("invalid mp4 box type % x at offset %d", boxType, boxStart)
+				return
+			}
+		}
+
+		size := boxSize32(v.boxHead)
+		minSize := int64(8)
+		switch size {
+		case 0:
+			v.boxEnd = -1
+			v.boxHead = v.boxHead[:0]
+			return
+		case 1:
+			size = 0
+			for _, b := range v.boxHead[8:16] {
+				size = size<<8 | int64(b)
+			}
+			minSize = 16
+		}
+
+		if size < minSize {
+			v.err = fmt.Errorf("invalid mp4 box size %d at offset %d", size, boxStart)
+			return
+		}
+
+		v.boxEnd = boxStart + size
+		v.boxHead = v.boxHead[:0]
+	}
+}
+
+func boxSize32(head []byte) int64 {
+	return int64(uint32(head[0])<<24 | uint32(head[1])<<16 | uint32(head[2])<<8 | uint32(head[3]))
+}
+
+// finish reports the validation result once the whole body was read.
+func (v *segmentValidator) finish() error {
+	size := v.size + int64(len(v.head))
+
+	if v.err != nil {
+		return v.err
+	}
+
+	switch v.format {
+	case formatUnknown:
+		if size == 0 {
+			return fmt.Errorf("empty segment")
+		}
+		return fmt.Errorf("segment too short (%d bytes)", size)
+	case formatTS:
+		if v.size%tsPacketSize != 0 {
+			return fmt.Errorf("truncated ts packet, %d bytes", v.size)
+		}
+	case formatMP4:
+		if len(v.boxHead) > 0 || (v.boxEnd >= 0 && v.boxEnd != v.size) {
+			return fmt.Errorf("truncated mp4 box at %d bytes", v.size)
+		}
+	}
+	return nil
+}
+
+type validationCount struct {
+	segments int64
+	corrupt  int64
+}
+
+type validationStats struct {
+	mu      sync.Mutex
+	servers map[string]*validationCount
+}
+
+var validation = &validationStats{servers: make(map[string]*validationCount)}
+
+func (s *validationStats) record(server string, corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.servers[server]
+	if !ok {
+		c = &validationCount{}
+		s.servers[server] = c
+	}
+	c.segments++
+	if corrupt {
+		c.corrupt++
+	}
+}
+
+func (s *validationStats) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []string
+	for server := range s.servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	log.Println("segment validation")
+	log.Printf("%-24s %10s %10s", "server", "segments", "corrupt")
+	for _, server := range servers {
+		c := s.servers[server]
+		log.Printf("%-24s %10d %10d", server, c.segments, c.corrupt)
+	}
+}